@@ -1,14 +1,539 @@
 package asm
 
 import (
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
+
+	"github.com/markcol/dcpu16/cpu"
+)
+
+var (
+	registers = map[string]uint16{
+		"A": cpu.A, "B": cpu.B, "C": cpu.C, "X": cpu.X,
+		"Y": cpu.Y, "Z": cpu.Z, "I": cpu.I, "J": cpu.J,
+	}
+	basicOpcodes = map[string]uint16{
+		"SET": cpu.SET, "ADD": cpu.ADD, "SUB": cpu.SUB, "MUL": cpu.MUL,
+		"MLI": cpu.MLI, "DIV": cpu.DIV, "DVI": cpu.DVI, "MOD": cpu.MOD,
+		"MDI": cpu.MDI, "AND": cpu.AND, "BOR": cpu.BOR, "XOR": cpu.XOR,
+		"SHR": cpu.SHR, "ASR": cpu.ASR, "SHL": cpu.SHL, "IFB": cpu.IFB,
+		"IFC": cpu.IFC, "IFE": cpu.IFE, "IFN": cpu.IFN, "IFG": cpu.IFG,
+		"IFA": cpu.IFA, "IFL": cpu.IFL, "IFU": cpu.IFU, "ADX": cpu.ADX,
+		"SBX": cpu.SBX, "STI": cpu.STI, "STD": cpu.STD,
+	}
+	extOpcodes = map[string]uint16{
+		"JSR": cpu.JSR, "INT": cpu.INT, "IAG": cpu.IAG, "IAS": cpu.IAS,
+		"RFI": cpu.RFI, "IAQ": cpu.IAQ, "HWN": cpu.HWN, "HWQ": cpu.HWQ,
+		"HWI": cpu.HWI,
+	}
 )
 
+// WordWriter is the interface that wraps the WriteWord method, which is used
+// by the assembler to emit the assembled program one word at a time.
 type WordWriter interface {
+	WriteWord(w uint16) error
+}
+
+// token is a piece of source text and the column it starts at.
+type token struct {
+	text string
+	col  int
+}
+
+// operand is a single instruction operand.
+type operand struct {
+	mode    uint16 // 6-bit addressing mode
+	hasNext bool   // true if the operand requires a next word
+	value   uint16 // next word value, if hasNext and symbol is empty
+	symbol  string // label whose address is added to value, if any
+	col     int    // source column, for reporting errors
+}
+
+// instruction is a single parsed instruction. Extended instructions have an
+// opcode of cpu.EXT, the extended opcode in ext and only the a operand. DAT
+// and RESW directives are represented as an instruction with one data operand
+// (which always has a next word) per emitted word.
+type instruction struct {
+	line   int
+	addr   uint16
+	opcode uint16
+	ext    uint16
+	a, b   operand
+	data   []operand
+	words  []uint16 // assembled words, filled in by the second pass
+}
+
+// size returns the number of words occupied by the instruction.
+func (in *instruction) size() uint16 {
+	if in.data != nil {
+		return uint16(len(in.data))
+	}
+	n := uint16(1)
+	if in.a.hasNext {
+		n++
+	}
+	if in.b.hasNext {
+		n++
+	}
+	return n
+}
+
+// constant is a name bound to a value by an EQU directive.
+type constant struct {
+	name  string
+	line  int
+	value operand
+}
+
+// assembler holds the state of resolving a single program.
+type assembler struct {
+	addr      uint16
+	insts     []*instruction
+	symbols   map[string]uint16
+	constants []constant      // in order of definition, resolved into symbols
+	used      map[string]bool // constant sets defined by .use
+	errs      ErrorList
+	source    []sourceLine
+}
+
+// sourceLine is a line of source text and the address it was assembled at.
+type sourceLine struct {
+	text string
+	addr uint16
 }
 
 // Assemble assembles a DCPU16 assembly language program, reading the source
 // file from r and writing the output to w.
+//
+// Assembly is performed in two passes. The first pass parses each line,
+// computes the address of every instruction and records the address of each
+// label. The second pass resolves label references and assembles the words.
+// If the source contains errors, nothing is written to w and the errors
+// found by both passes are returned as an ErrorList.
 func Assemble(r io.Reader, w WordWriter) (err error) {
+	a, err := assemble(r)
+	if err != nil {
+		return err
+	}
+	return a.writeWords(w)
+}
+
+// assemble parses and resolves the program read from r.
+func assemble(r io.Reader) (*assembler, error) {
+	p, err := ParseProgram(r)
+	if _, ok := err.(ErrorList); err != nil && !ok {
+		return nil, err
+	}
+	if err := p.Resolve(); err != nil {
+		return nil, err
+	}
+	return p.a, nil
+}
+
+// layout assigns an address to each statement of p in turn, defining its
+// labels and constants, and then resolves the program. The errors found
+// while parsing p are reported along with those found by layout.
+func layout(p *Program) *assembler {
+	a := &assembler{symbols: make(map[string]uint16), source: p.source}
+	a.errs = append(a.errs, p.errs...)
+	line := 0 // the number of source lines given an address
+	end := 0  // a.addr, without wrapping at the end of memory
+	for _, st := range p.Statements {
+		for ; line < st.Line && line < len(a.source); line++ {
+			a.source[line].addr = a.addr
+		}
+		switch {
+		case st.Kind == STMT_LABEL:
+			a.defineLabel(st.Line, st.Col, st.Name)
+		case st.equ != nil:
+			a.defineConstant(st.Line, st.Col, st.Name, *st.equ)
+		case st.set != "":
+			a.use(st.Line, st.Args[0].Col, st.set)
+		case strings.EqualFold(st.Op, "RESW") && end+int(st.insts[0].size()) > 0x10000:
+			a.errorf(st.Line, st.Args[0].Col, "RESW %s overflows the address space", st.Args[0].Text)
+		default:
+			for _, in := range st.insts {
+				in.addr = a.addr
+				a.insts = append(a.insts, in)
+				a.addr += in.size()
+				end += int(in.size())
+			}
+		}
+	}
+	for ; line < len(a.source); line++ {
+		a.source[line].addr = a.addr
+	}
+	a.resolve()
+	a.errs.sort()
+	return a
+}
+
+// writeWords writes the assembled program to w.
+func (a *assembler) writeWords(w WordWriter) error {
+	for _, in := range a.insts {
+		for _, v := range in.words {
+			if err := w.WriteWord(v); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
+
+// errorf records an error at the given line and column.
+func (a *assembler) errorf(line, col int, format string, args ...interface{}) {
+	a.errs = append(a.errs, &AssembleError{line, col, fmt.Sprintf(format, args...)})
+}
+
+// defineLabel defines the label name at the current address.
+func (a *assembler) defineLabel(line, col int, name string) {
+	if a.defined(name) {
+		a.errorf(line, col, "label %q redefined", name)
+		return
+	}
+	a.symbols[name] = a.addr
+}
+
+// defineConstant defines the constant name with the given value. The value
+// may refer to labels and to constants defined before it.
+func (a *assembler) defineConstant(line, col int, name string, value operand) {
+	if a.defined(name) {
+		a.errorf(line, col, "constant %q redefined", name)
+		return
+	}
+	a.constants = append(a.constants, constant{name, line, value})
+}
+
+// defined reports whether name is already defined as a label or constant.
+func (a *assembler) defined(name string) bool {
+	if _, ok := a.symbols[name]; ok {
+		return true
+	}
+	for _, c := range a.constants {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// skipSpace returns the index of the first non-blank character in s at or
+// after i.
+func skipSpace(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// skipToken returns the index of the first blank character in s at or after
+// i.
+func skipToken(s string, i int) int {
+	for i < len(s) && s[i] != ' ' && s[i] != '\t' {
+		i++
+	}
+	return i
+}
+
+// stripComment returns text with any ; comment removed. Semicolons inside
+// string and character literals do not start a comment.
+func stripComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++ // skip the escaped character
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ';':
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// splitArgs splits the comma separated operands in s, starting at index i.
+// Commas inside string and character literals do not separate operands.
+func splitArgs(s string, i int) []token {
+	var args []token
+	if strings.TrimSpace(s[i:]) == "" {
+		return args
+	}
+	var quote byte
+	start := i
+	for ; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			args = append(args, trimToken(s, start, i))
+			start = i + 1
+		}
+	}
+	return append(args, trimToken(s, start, len(s)))
+}
+
+// trimToken returns the token s[i:j] with surrounding blanks removed.
+func trimToken(s string, i, j int) token {
+	i = skipSpace(s, i)
+	return token{strings.TrimSpace(s[i:j]), i + 1}
+}
+
+// parseData parses the values of a DAT directive. Each number, character
+// literal or label emits one word, and each double quoted string emits one
+// word per character, which must be at most 0xffff. On error, the offending
+// value is returned.
+func parseData(args []token) ([]operand, token, error) {
+	var data []operand
+	for _, arg := range args {
+		if strings.HasPrefix(arg.text, "\"") {
+			str, err := strconv.Unquote(arg.text)
+			if err != nil {
+				return nil, arg, fmt.Errorf("invalid string %s", arg.text)
+			}
+			for _, c := range str {
+				if c > 0xffff {
+					return nil, arg, fmt.Errorf("character %U in string %s does not fit in 16 bits", c, arg.text)
+				}
+				data = append(data, operand{hasNext: true, value: uint16(c)})
+			}
+			continue
+		}
+		o, err := parseValue(arg.text)
+		if err != nil {
+			return nil, arg, err
+		}
+		o.col = arg.col
+		data = append(data, o)
+	}
+	return data, token{}, nil
+}
+
+// parseReserve parses the word count of a RESW directive, returning that many
+// zero data words. The count must be a number, since the address of every
+// instruction is fixed during the first pass, and may not be negative.
+func parseReserve(s string) ([]operand, error) {
+	if strings.HasPrefix(s, "-") {
+		return nil, fmt.Errorf("RESW count %s is negative", s)
+	}
+	o, err := parseValue(s)
+	if err != nil {
+		return nil, err
+	}
+	if o.symbol != "" {
+		return nil, fmt.Errorf("RESW count must be a number")
+	}
+	data := make([]operand, o.value)
+	for i := range data {
+		data[i].hasNext = true
+	}
+	return data, nil
+}
+
+// parseOperand parses the operand s. isA is true for the a operand, which is
+// the only operand that can hold a short literal or POP, while PUSH is only
+// valid as the b operand. The recognized forms are:
+//
+//	A, B, C, X, Y, Z, I, J      register
+//	[A] ... [J]                 [register]
+//	[next+A], [A+next], [A-n]   [next word + register]
+//	POP / PUSH, PEEK, PICK n    stack operations; [SP], [SP+n] and [SP-n] are aliases
+//	SP, PC, EX (or O)           special registers
+//	[next]                      [next word]
+//	next                        literal value
+func parseOperand(t token, isA bool) (o operand, err error) {
+	o, err = parseMode(t.text, isA)
+	o.col = t.col
+	return o, err
+}
+
+// parseMode parses the addressing mode and next word of operand s.
+func parseMode(s string, isA bool) (operand, error) {
+	u := strings.ToUpper(s)
+	if r, ok := registers[u]; ok {
+		return operand{mode: r}, nil
+	}
+	switch u {
+	case "POP":
+		if !isA {
+			return operand{}, fmt.Errorf("POP is only valid as the a operand")
+		}
+		return operand{mode: 0x18}, nil
+	case "PUSH":
+		if isA {
+			return operand{}, fmt.Errorf("PUSH is only valid as the b operand")
+		}
+		return operand{mode: 0x18}, nil
+	case "PEEK", "[SP]":
+		return operand{mode: 0x19}, nil
+	case "SP":
+		return operand{mode: 0x1b}, nil
+	case "PC":
+		return operand{mode: 0x1c}, nil
+	case "EX", "O":
+		return operand{mode: 0x1d}, nil
+	}
+	if strings.HasPrefix(u, "PICK ") {
+		o, err := parseValue(strings.TrimSpace(s[len("PICK "):]))
+		o.mode = 0x1a
+		return o, err
+	}
+
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		if r, ok := registers[strings.ToUpper(inner)]; ok {
+			return operand{mode: 0x08 + r}, nil // [register]
+		}
+		// the operator is the first + or - after any leading minus sign
+		i := -1
+		if len(inner) > 1 {
+			i = strings.IndexAny(inner[1:], "+-") + 1
+		}
+		if i > 0 {
+			// [next word + register] in either order, [register - number],
+			// or the same forms with SP
+			lhs := strings.TrimSpace(inner[:i])
+			rhs := strings.TrimSpace(inner[i+1:])
+			if inner[i] == '-' {
+				// subtracting n is adding -n, which parseValue rejects for
+				// labels
+				lhs, rhs = rhs, lhs
+				if !strings.HasPrefix(lhs, "-") {
+					lhs = "-" + lhs
+				} else {
+					lhs = lhs[1:]
+				}
+			} else if _, ok := registers[strings.ToUpper(lhs)]; ok || strings.ToUpper(lhs) == "SP" {
+				lhs, rhs = rhs, lhs
+			}
+			mode := uint16(0x1a) // PICK
+			if r, ok := registers[strings.ToUpper(rhs)]; ok {
+				mode = 0x10 + r
+			} else if strings.ToUpper(rhs) != "SP" {
+				return operand{}, fmt.Errorf("invalid operand %q", s)
+			}
+			o, err := parseValue(lhs)
+			o.mode = mode
+			return o, err
+		}
+		o, err := parseValue(inner) // [next word]
+		o.mode = 0x1e
+		return o, err
+	}
+
+	o, err := parseValue(s)
+	if err != nil {
+		return o, err
+	}
+	if mode, ok := cpu.ShortLiteralMode(o.value); isA && o.symbol == "" && ok {
+		return operand{mode: mode}, nil // short literal (-1..30)
+	}
+	o.mode = 0x1f // next word literal
+	return o, nil
+}
+
+// parseValue parses a numeric literal or label reference into the next word
+// of an operand. Numbers may be decimal (10), hexadecimal (0x0a), binary
+// (0b1010) or a character literal ('A'). A number preceded by a minus sign
+// (-1) is stored in two's complement, and must be no less than -0x8000.
+func parseValue(s string) (operand, error) {
+	if s == "" {
+		return operand{}, fmt.Errorf("missing value")
+	}
+	if s[0] == '-' {
+		o, err := parseValue(strings.TrimSpace(s[1:]))
+		if err != nil {
+			return o, err
+		}
+		if o.symbol != "" {
+			return operand{}, fmt.Errorf("cannot negate label %q", o.symbol)
+		}
+		if o.value > 0x8000 {
+			return operand{}, fmt.Errorf("value %s does not fit in 16 bits", s)
+		}
+		o.value = -o.value
+		return o, nil
+	}
+	if s[0] == '\'' {
+		v, _, tail, err := strconv.UnquoteChar(s[1:], '\'')
+		if err != nil || tail != "'" || v > 0xffff {
+			return operand{}, fmt.Errorf("invalid character %s", s)
+		}
+		return operand{hasNext: true, value: uint16(v)}, nil
+	}
+	if c := s[0]; c >= '0' && c <= '9' {
+		base, digits := 10, s
+		if len(s) > 2 && s[0] == '0' {
+			switch s[1] {
+			case 'x', 'X':
+				base, digits = 16, s[2:]
+			case 'b', 'B':
+				base, digits = 2, s[2:]
+			}
+		}
+		v, err := strconv.ParseUint(digits, base, 16)
+		if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange {
+			return operand{}, fmt.Errorf("value %s does not fit in 16 bits", s)
+		} else if err != nil {
+			return operand{}, fmt.Errorf("invalid number %q", s)
+		}
+		return operand{hasNext: true, value: uint16(v)}, nil
+	}
+	return operand{hasNext: true, symbol: s}, nil
+}
+
+// resolve performs the second pass, resolving constants and label references
+// and assembling the words of each instruction.
+func (a *assembler) resolve() {
+	for _, c := range a.constants {
+		a.symbols[c.name] = a.value(&instruction{line: c.line}, c.value)
+	}
+	for _, in := range a.insts {
+		in.words = nil
+		if in.data != nil {
+			for _, o := range in.data {
+				in.words = append(in.words, a.value(in, o))
+			}
+			continue
+		}
+
+		w := in.opcode | in.a.mode<<cpu.ARGA_SHIFT
+		if in.opcode == cpu.EXT {
+			w |= in.ext << cpu.ARGB_SHIFT
+		} else {
+			w |= in.b.mode << cpu.ARGB_SHIFT
+		}
+		in.words = append(in.words, w)
+		// the a operand's next word precedes the b operand's
+		for _, o := range []operand{in.a, in.b} {
+			if o.hasNext {
+				in.words = append(in.words, a.value(in, o))
+			}
+		}
+	}
+}
+
+// value returns the next word value of operand o of instruction in.
+func (a *assembler) value(in *instruction, o operand) uint16 {
+	v := o.value
+	if o.symbol != "" {
+		addr, ok := a.symbols[o.symbol]
+		if !ok {
+			a.errorf(in.line, o.col, "undefined label %q", o.symbol)
+		}
+		v += addr
+	}
+	return v
+}
@@ -1,43 +1,510 @@
 package asm
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/markcol/dcpu16/cpu"
 )
 
+// wordBuffer is a WordWriter that collects the words written to it.
+type wordBuffer []uint16
+
+func (b *wordBuffer) WriteWord(w uint16) error {
+	*b = append(*b, w)
+	return nil
+}
+
+// assertAssembles assembles src and reports any difference between the
+// assembled words and want, one word per line, at the caller's position.
+func assertAssembles(t *testing.T, src string, want []uint16) {
+	t.Helper()
+	var got wordBuffer
+	if err := Assemble(strings.NewReader(src), &got); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+		return
+	}
+	if diff := diffWords(got, want); diff != nil {
+		t.Errorf("assembled words differ:\n%s", strings.Join(diff, ""))
+	}
+}
+
+// diffWords returns a line giving the address and the words got and wanted
+// for each word where got and want differ, or nil if they are the same.
+func diffWords(got, want []uint16) []string {
+	var diff []string
+	for i := 0; i < len(got) || i < len(want); i++ {
+		switch {
+		case i >= len(got):
+			diff = append(diff, fmt.Sprintf("0x%04x: got <none>, want 0x%04x\n", i, want[i]))
+		case i >= len(want):
+			diff = append(diff, fmt.Sprintf("0x%04x: got 0x%04x, want <none>\n", i, got[i]))
+		case got[i] != want[i]:
+			diff = append(diff, fmt.Sprintf("0x%04x: got 0x%04x, want 0x%04x\n", i, got[i], want[i]))
+		}
+	}
+	return diff
+}
+
+func TestDiffWords(t *testing.T) {
+	if diff := diffWords([]uint16{1, 2, 3}, []uint16{1, 2, 3}); diff != nil {
+		t.Errorf("Expected no differences, got %q\n", diff)
+	}
+	expect := []string{
+		"0x0001: got 0x0002, want 0x0005\n",
+		"0x0003: got <none>, want 0x0004\n",
+	}
+	diff := diffWords([]uint16{1, 2, 3}, []uint16{1, 5, 3, 4})
+	if strings.Join(diff, "") != strings.Join(expect, "") {
+		t.Errorf("Expected %q, got %q\n", expect, diff)
+	}
+	expect = []string{"0x0001: got 0x0002, want <none>\n"}
+	diff = diffWords([]uint16{1, 2}, []uint16{1})
+	if strings.Join(diff, "") != strings.Join(expect, "") {
+		t.Errorf("Expected %q, got %q\n", expect, diff)
+	}
+}
+
+// sample is the sample program from the specification. The comment on each
+// line gives the words it assembles to.
+const sample = "; Try some basic stuff\n" +
+	"              SET A, 0x30              ; 7c01 0030\n" +
+	"              SET [0x1000], 0x20       ; 7fc1 0020 1000\n" +
+	"              SUB A, [0x1000]          ; 7803 1000\n" +
+	"              IFN A, 0x10              ; c413\n" +
+	"              SET PC, crash            ; 7f81 001a" +
+	"\n" +
+	"; Do a loopy thing\n" +
+	"              SET I, 10                ; acc1\n" +
+	"              SET A, 0x2000            ; 7c01 2000\n" +
+	":loop         SET [0x2000+I], [A]      ; 22c1 2000\n" +
+	"              SUB I, 1                 ; 88c3\n" +
+	"              IFN I, 0                 ; 84d3\n" +
+	"              SET PC, loop             ; 7f81 000d\n" +
+	"\n" +
+	"; Call a subroutine\n" +
+	"              SET X, 0x4               ; 9461\n" +
+	"              JSR testsub              ; 7c20 0018 [*]\n" +
+	"              SET PC, crash            ; 7f81 001a [*]\n" +
+	"\n" +
+	":testsub      SHL X, 4                 ; 946f\n" +
+	"              SET PC, POP              ; 6381\n" +
+	"\n" +
+	"; Hang forever. X should now be 0x40 if everything went right.\n" +
+	":crash        SET PC, crash            ; 7f81 001a [*]\n"
+
+// sampleWords is the assembled sample program.
+var sampleWords = []uint16{
+	0x7c01, 0x0030, 0x7fc1, 0x0020, 0x1000, 0x7803, 0x1000, 0xc413,
+	0x7f81, 0x001a, 0xacc1, 0x7c01, 0x2000, 0x22c1, 0x2000, 0x88c3,
+	0x84d3, 0x7f81, 0x000d, 0x9461, 0x7c20, 0x0018, 0x7f81, 0x001a,
+	0x946f, 0x6381, 0x7f81, 0x001a,
+}
+
 func TestSimple(t *testing.T) {
-	input := "; Try some basic stuff\n" +
-		"              SET A, 0x30              ; 7c01 0030\n" +
-		"              SET [0x1000], 0x20       ; 7de1 1000 0020\n" +
-		"              SUB A, [0x1000]          ; 7803 1000\n" +
-		"              IFN A, 0x10              ; c00d\n" +
-		"              SET PC, crash            ; 7dc1 001a" +
-		"\n" +
-		"; Do a loopy thing\n" +
-		"              SET I, 10                ; a861\n" +
-		"              SET A, 0x2000            ; 7c01 2000\n" +
-		":loop         SET [0x2000+I], [A]      ; 2161 2000\n" +
-		"              SUB I, 1                 ; 8463\n" +
-		"              IFN I, 0                 ; 806d\n" +
-		"              SET PC, loop             ; 7dc1 000d\n" +
-		"\n" +
-		"; Call a subroutine\n" +
-		"              SET X, 0x4               ; 9031\n" +
-		"              JSR testsub              ; 7c10 0018 [*]\n" +
-		"              SET PC, crash            ; 7dc1 001a [*]\n" +
-		"\n" +
-		":testsub      SHL X, 4                 ; 9037\n" +
-		"              SET PC, POP              ; 61c1\n" +
-		"\n" +
-		"; Hang forever. X should now be 0x40 if everything went right.\n" +
-		":crash        SET PC, crash            ; 7dc1 001a [*]\n"
+	assertAssembles(t, sample, sampleWords)
+}
+
+func TestErrors(t *testing.T) {
+	inputs := []string{
+		"FOO A, B\n",
+		"SET A\n",
+		"SET PC, nowhere\n",
+		"SET A, 0x10000\n",
+		"SET A, 0b102\n",
+		"SET A, 0x\n",
+		"SET A, 'AB'\n",
+		"DAT \"\U0001F600\"\n",
+		"SET [0x10+Q], B\n",
+		"SET POP, A\n",
+		"SET A, PUSH\n",
+		"RESW\n",
+		"RESW count\n",
+		"X EQU 1\nX EQU 2\n",
+		":X\nX EQU 1\n",
+		"X EQU 1\n:X\n",
+		"X EQU Y\nY EQU 1\n",
+		":f\n:.loop\n:.loop\n",
+		":f\n:.loop\n:g SET PC, .loop\n",
+		"SET A, -0x8001\n",
+		"SET A, -label\n:label\n",
+		"SET A, [I-label]\n:label\n",
+		".use\n",
+		".use lem1803\n",
+		"MEM_MAP_SCREEN EQU 1\n.use lem1802\n",
+		"PUSHALL\n",
+		"POPALL A, [B]\n",
+	}
+	for _, input := range inputs {
+		var b wordBuffer
+		if err := Assemble(strings.NewReader(input), &b); err == nil {
+			t.Errorf("Expected an error assembling %q\n", input)
+		}
+	}
+}
+
+func TestForwardReference(t *testing.T) {
+	// Labels always use the next word form, even when their address would
+	// fit in a short literal, since it isn't known during the first pass.
+	input := ":start  SET A, end     ; 7c01 0004\n" +
+		"        SET B, start   ; 7c21 0000\n" +
+		":end"
+	expect := []uint16{0x7c01, 0x0004, 0x7c21, 0x0000}
+
+	assertAssembles(t, input, expect)
+}
+
+func TestNoTrailingNewline(t *testing.T) {
+	// the last instruction must not be dropped
+	input := "        SET A, 1              ; 8801\n" +
+		":crash  SET PC, crash         ; 7f81 0001"
+	assertAssembles(t, input, []uint16{0x8801, 0x7f81, 0x0001})
 
+	// nor the last label
+	input = "        SET A, end            ; 7c01 0002\n" +
+		":end"
+	assertAssembles(t, input, []uint16{0x7c01, 0x0002})
+
+	// Windows line endings
+	assertAssembles(t, "SET A, 1\r\nSET B, 2\r\n", []uint16{0x8801, 0x8c21})
+}
+
+func TestUnterminatedComment(t *testing.T) {
+	// a comment that runs to the end of the file, even one containing an
+	// unbalanced quote
+	input := "SET A, 1\n" +
+		"SET B, 2 ; don't stop"
+	assertAssembles(t, input, []uint16{0x8801, 0x8c21})
+	assertAssembles(t, "SET A, 1\n; the end", []uint16{0x8801})
+
+	// an error on the last line is reported there
+	var b wordBuffer
+	err := Assemble(strings.NewReader("SET A, 1\nSET PC, nowhere ; no newline"), &b)
+	if errs, ok := err.(ErrorList); !ok || len(errs) != 1 || errs[0].Line != 2 || errs[0].Col != 9 {
+		t.Errorf("Expected an undefined label at 2:9, got: %v\n", err)
+	}
+}
+
+func TestLongLine(t *testing.T) {
+	// lines are not limited in length
+	n := 30000
+	input := "DAT " + strings.Repeat("1, ", n-1) + "1"
+	expect := make([]uint16, n)
+	for i := range expect {
+		expect[i] = 1
+	}
+	assertAssembles(t, input, expect)
+}
+
+func TestDAT(t *testing.T) {
+	input := "        SET A, table             ; 7c01 0004\n" +
+		"        SET B, msg               ; 7c21 0008\n" +
+		":table  DAT 1, 0x20, 'A', end    ; 0001 0020 0041 000f\n" +
+		":msg    DAT \"Hi, \\\";\", 0   ; 0048 0069 002c 0020 0022 003b 0000\n" +
+		":end"
+	expect := []uint16{
+		0x7c01, 0x0004, 0x7c21, 0x0008, 0x0001, 0x0020, 0x0041, 0x000f,
+		0x0048, 0x0069, 0x002c, 0x0020, 0x0022, 0x003b, 0x0000,
+	}
+
+	assertAssembles(t, input, expect)
+}
+
+func TestDATForwardReference(t *testing.T) {
+	// a jump table of labels and a constant that are defined after it
+	input := "        SET A, [table+I]          ; 5801 0003\n" +
+		"        SET PC, A                 ; 0381\n" +
+		":table  DAT first, second, last   ; 0006 0008 000b\n" +
+		":first  SET B, count              ; 7c21 0003\n" +
+		":second SET B, 2                  ; 8c21\n" +
+		"        SET PC, last              ; 7f81 000b\n" +
+		":last   DAT count, end            ; 0003 000d\n" +
+		"count   EQU 3\n" +
+		":end"
 	expect := []uint16{
-		0x7c01, 0x0030, 0x7de1, 0x1000, 0x0020, 0x7803, 0x1000, 0xc00d,
-		0x7dc1, 0x001a, 0xa861, 0x7c01, 0x2000, 0x2161, 0x2000, 0x8463,
-		0x806d, 0x7dc1, 0x000d, 0x9031, 0x7c10, 0x0018, 0x7dc1, 0x001a,
-		0x9037, 0x61c1, 0x7dc1, 0x001a,
+		0x5801, 0x0003, 0x0381, 0x0006, 0x0008, 0x000b, 0x7c21, 0x0003,
+		0x8c21, 0x7f81, 0x000b, 0x0003, 0x000d,
 	}
+	assertAssembles(t, input, expect)
+
+	// an undefined label in DAT is reported at its column
+	var b wordBuffer
+	err := Assemble(strings.NewReader(":table DAT first, nowhere\n:first"), &b)
+	if errs, ok := err.(ErrorList); !ok || len(errs) != 1 || *errs[0] != (AssembleError{1, 19, `undefined label "nowhere"`}) {
+		t.Errorf("Expected an undefined label at 1:19, got: %v\n", err)
+	}
+}
+
+func TestRESW(t *testing.T) {
+	input := "        SET A, end               ; 7c01 0012\n" +
+		":buffer RESW 16                  ; 0000 * 16\n" +
+		":end    SET B, buffer            ; 7c21 0002\n"
+	expect := make([]uint16, 2+16+2)
+	expect[0], expect[1] = 0x7c01, 0x0012
+	expect[18], expect[19] = 0x7c21, 0x0002
+
+	assertAssembles(t, input, expect)
+}
+
+func TestRESWErrors(t *testing.T) {
+	input := "SET A, 1\n" +
+		":buffer RESW -1\n" +
+		"        RESW 0xffff\n" +
+		"        RESW 0x10\n"
+	expect := []AssembleError{
+		{2, 14, "RESW count -1 is negative"},
+		{4, 14, "RESW 0x10 overflows the address space"},
+	}
+
+	var b wordBuffer
+	err := Assemble(strings.NewReader(input), &b)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("Expected an ErrorList, got: %v\n", err)
+	}
+	if len(errs) != len(expect) {
+		t.Fatalf("Expected %d errors, got %d: %v\n", len(expect), len(errs), errs)
+	}
+	for i, e := range expect {
+		if *errs[i] != e {
+			t.Errorf("Expected error %q, got %q\n", e.Error(), errs[i])
+		}
+	}
+}
+
+func TestEQU(t *testing.T) {
+	input := "SCREEN  EQU 0x8000\n" +
+		"LENGTH  equ 384\n" +
+		"        SET [SCREEN+I], LENGTH   ; 7ec1 0180 8000\n" +
+		"        SET A, SCREEN            ; 7c01 8000\n" +
+		"        SET PC, last             ; 7f81 0007\n" +
+		"LAST    EQU end\n" +
+		"last    EQU LAST\n" +
+		":end"
+	expect := []uint16{0x7ec1, 0x0180, 0x8000, 0x7c01, 0x8000, 0x7f81, 0x0007}
 
-	_ = input
-	_ = expect
+	assertAssembles(t, input, expect)
+}
+
+func TestUse(t *testing.T) {
+	input := ".use lem1802\n" +
+		"        SET A, MEM_MAP_SCREEN    ; 7c01 0000\n" +
+		"        SET B, COLOR_WHITE       ; 7c21 000f\n" +
+		"        IFE C, KEY_RETURN        ; 7c52 0011\n" +
+		".USE LEM1802\n"
+	expect := []uint16{0x7c01, 0x0000, 0x7c21, 0x000f, 0x7c52, 0x0011}
+
+	assertAssembles(t, input, expect)
+}
+
+func TestLocalLabels(t *testing.T) {
+	input := ":func1  SET I, 10                ; acc1\n" +
+		":.loop  SUB I, 1                 ; 88c3\n" +
+		"        IFN I, 0                 ; 84d3\n" +
+		"        SET PC, .loop            ; 7f81 0001\n" +
+		"        SET PC, POP              ; 6381\n" +
+		":func2  SET J, 10                ; ace1\n" +
+		":.loop  SUB J, 1                 ; 88e3\n" +
+		"        IFN J, 0                 ; 84f3\n" +
+		"        SET PC, .loop            ; 7f81 0007\n" +
+		"        SET PC, func1.loop       ; 7f81 0001\n"
+	expect := []uint16{
+		0xacc1, 0x88c3, 0x84d3, 0x7f81, 0x0001, 0x6381,
+		0xace1, 0x88e3, 0x84f3, 0x7f81, 0x0007, 0x7f81, 0x0001,
+	}
+
+	assertAssembles(t, input, expect)
+}
+
+func TestNumericLiterals(t *testing.T) {
+	input := "SET A, 10        ; ac01\n" +
+		"SET A, 010       ; ac01\n" +
+		"SET A, 0x0a      ; ac01\n" +
+		"SET A, 0X1E      ; fc01\n" +
+		"SET A, 0b1010    ; ac01\n" +
+		"SET A, 'A'       ; 7c01 0041\n" +
+		"SET A, 30        ; fc01\n" +
+		"SET A, 31        ; 7c01 001f\n" +
+		"SET A, 0         ; 8401\n" +
+		"SET A, 0xffff    ; 8001\n"
+	expect := []uint16{
+		0xac01, 0xac01, 0xac01, 0xfc01, 0xac01, 0x7c01, 0x0041, 0xfc01,
+		0x7c01, 0x001f, 0x8401, 0x8001,
+	}
+
+	assertAssembles(t, input, expect)
+}
+
+func TestShortLiterals(t *testing.T) {
+	input := "SET I, 10         ; acc1\n" +
+		"SET A, 0x30       ; 7c01 0030\n" +
+		"SET A, 0xffff     ; 8001\n" +
+		"SET [0x10], 1     ; 8bc1 0010\n" +
+		"SET PUSH, 30      ; ff01\n" +
+		"SET PC, here      ; 7f81 0009\n" +
+		":here\n"
+	expect := []uint16{
+		0xacc1, 0x7c01, 0x0030, 0x8001, 0x8bc1, 0x0010, 0xff01, 0x7f81,
+		0x0009,
+	}
+
+	assertAssembles(t, input, expect)
+}
+
+func TestAddressingModes(t *testing.T) {
+	input := "SET A, B              ; 0401\n" +
+		"SET J, [C]            ; 28e1\n" +
+		"SET [0x2000+I], [A]   ; 22c1 2000\n" +
+		"SET [ J + 0x10 ], 1   ; 8ae1 0010\n" +
+		"SET PUSH, POP         ; 6301\n" +
+		"SET A, PEEK           ; 6401\n" +
+		"SET A, [SP]           ; 6401\n" +
+		"SET A, PICK 3         ; 6801 0003\n" +
+		"SET [SP+3], A         ; 0341 0003\n" +
+		"SET SP, 0             ; 8761\n" +
+		"SET PC, POP           ; 6381\n" +
+		"SET EX, O             ; 77a1\n" +
+		"SUB A, [0x1000]       ; 7803 1000\n" +
+		"SET [0x1000], 0x20    ; 7fc1 0020 1000\n"
+	expect := []uint16{
+		0x0401, 0x28e1, 0x22c1, 0x2000, 0x8ae1, 0x0010, 0x6301, 0x6401,
+		0x6401, 0x6801, 0x0003, 0x0341, 0x0003, 0x8761, 0x6381, 0x77a1,
+		0x7803, 0x1000, 0x7fc1, 0x0020, 0x1000,
+	}
+
+	assertAssembles(t, input, expect)
+}
+
+func TestNegativeValues(t *testing.T) {
+	input := "SET A, -1             ; 8001\n" +
+		"SET A, -2             ; 7c01 fffe\n" +
+		"SET A, [I-1]          ; 5801 ffff\n" +
+		"SET A, [-1+I]         ; 5801 ffff\n" +
+		"SET [J - 0x10], 1     ; 8ae1 fff0\n" +
+		"SET A, PICK -1        ; 6801 ffff\n" +
+		"SET A, [SP-1]         ; 6801 ffff\n" +
+		"DAT -1, -0x8000       ; ffff 8000\n"
+	expect := []uint16{
+		0x8001, 0x7c01, 0xfffe, 0x5801, 0xffff, 0x5801, 0xffff, 0x8ae1,
+		0xfff0, 0x6801, 0xffff, 0x6801, 0xffff, 0xffff, 0x8000,
+	}
+
+	assertAssembles(t, input, expect)
+}
+
+func TestNegativeOffsetExecution(t *testing.T) {
+	input := "SET I, 0x10\n" +
+		"SET A, [I-1]      ; reads 0x000f\n" +
+		"SET B, [I-0x11]   ; wraps around to 0xffff\n"
+	var b wordBuffer
+	if err := Assemble(strings.NewReader(input), &b); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	c := cpu.NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, b)
+	c.Write(0x000f, []uint16{0x1234})
+	c.Write(0xffff, []uint16{0x5678})
+	c.StepN(3)
+	if a, _ := c.GetRegister("A"); a != 0x1234 {
+		t.Errorf("Expected A to be 0x1234, got 0x%04x\n", a)
+	}
+	if v, _ := c.GetRegister("B"); v != 0x5678 {
+		t.Errorf("Expected B to be 0x5678, got 0x%04x\n", v)
+	}
+}
+
+func TestPushAllPopAll(t *testing.T) {
+	input := "PUSHALL A, B, C   ; 0301 0701 0b01\n" +
+		"POPALL A, b, C    ; 6041 6021 6001\n"
+	expect := []uint16{0x0301, 0x0701, 0x0b01, 0x6041, 0x6021, 0x6001}
+
+	assertAssembles(t, input, expect)
+}
+
+func TestPushAllPopAllExecution(t *testing.T) {
+	input := "SET A, 1\n" +
+		"SET B, 2\n" +
+		"SET C, 3\n" +
+		"PUSHALL A, B, C\n" +
+		"SET A, 0\n" +
+		"SET B, 0\n" +
+		"SET C, 0\n" +
+		"POPALL A, B, C\n"
+	var b wordBuffer
+	if err := Assemble(strings.NewReader(input), &b); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	c := cpu.NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, b)
+	c.StepN(12)
+	r := c.Registers()
+	if r[cpu.A] != 1 || r[cpu.B] != 2 || r[cpu.C] != 3 || r[cpu.SP] != 0 {
+		t.Errorf("Expected A=1, B=2, C=3, SP=0, got: %v\n", r)
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	input := "SET A, 1\n" +
+		"FOO A, B\n" +
+		"  SET A, 0x10000\n" +
+		"SET PC, nowhere   ; undefined\n" +
+		":dup SET A, 1\n" +
+		":dup\n" +
+		"\tSET POP, A\n" +
+		"DAT 1, \"a\U0001F600\"\n"
+	expect := []AssembleError{
+		{2, 1, `unknown opcode "FOO"`},
+		{3, 10, "value 0x10000 does not fit in 16 bits"},
+		{4, 9, `undefined label "nowhere"`},
+		{6, 1, `label "dup" redefined`},
+		{7, 6, "POP is only valid as the a operand"},
+		{8, 8, "character U+1F600 in string \"a\U0001F600\" does not fit in 16 bits"},
+	}
+
+	var b wordBuffer
+	err := Assemble(strings.NewReader(input), &b)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("Expected an ErrorList, got: %v\n", err)
+	}
+	if len(b) != 0 {
+		t.Errorf("Expected no output, got: %04x\n", b)
+	}
+	if len(errs) != len(expect) {
+		t.Fatalf("Expected %d errors, got %d: %v\n", len(expect), len(errs), errs)
+	}
+	for i, e := range expect {
+		if *errs[i] != e {
+			t.Errorf("Expected error %q, got %q\n", e.Error(), errs[i])
+		}
+	}
+}
+
+func TestOpcodes(t *testing.T) {
+	basic := map[string]uint16{
+		"SET": 0x01, "ADD": 0x02, "SUB": 0x03, "MUL": 0x04, "MLI": 0x05,
+		"DIV": 0x06, "DVI": 0x07, "MOD": 0x08, "MDI": 0x09, "AND": 0x0a,
+		"BOR": 0x0b, "XOR": 0x0c, "SHR": 0x0d, "ASR": 0x0e, "SHL": 0x0f,
+		"IFB": 0x10, "IFC": 0x11, "IFE": 0x12, "IFN": 0x13, "IFG": 0x14,
+		"IFA": 0x15, "IFL": 0x16, "IFU": 0x17, "ADX": 0x1a, "SBX": 0x1b,
+		"STI": 0x1e, "STD": 0x1f,
+	}
+	for name, op := range basic {
+		// b = A (0x00), a = B (0x01)
+		assertAssembles(t, name+" A, B", []uint16{0x0400 | op})
+	}
+
+	extended := map[string]uint16{
+		"JSR": 0x01, "INT": 0x08, "IAG": 0x09, "IAS": 0x0a, "RFI": 0x0b,
+		"IAQ": 0x0c, "HWN": 0x10, "HWQ": 0x11, "HWI": 0x12,
+	}
+	for name, op := range extended {
+		// a = X (0x03)
+		assertAssembles(t, name+" X", []uint16{0x0c00 | op<<cpu.ARGB_SHIFT})
+	}
 }
@@ -0,0 +1,77 @@
+package asm
+
+import (
+	"fmt"
+)
+
+// Operand is an instruction operand passed to Assembler.Inst, written as it
+// would be in assembly source (e.g. "A", "[0x2000+I]", "PICK 1" or the name
+// of a label).
+type Operand string
+
+// Assembler builds a program one statement at a time, for tools that
+// generate code and would otherwise have to write it out as source text for
+// Assemble. Labels may be referred to before they are defined. Operands are
+// parsed and labels resolved exactly as they are by Assemble.
+//
+// Errors are reported by Emit as an ErrorList in which the Line of each error
+// is the number of the Label, Inst or Data call that caused it, starting at 1,
+// and the Col is 1.
+//
+// The zero value is an empty program, ready to use.
+type Assembler struct {
+	prog Program
+	p    parser
+	line int // number of statements added
+}
+
+// next returns the parser, ready to add the next statement.
+func (asm *Assembler) next() *parser {
+	asm.p.prog = &asm.prog
+	asm.line++
+	return &asm.p
+}
+
+// Label defines the label name at the address of the next statement. Names
+// that begin with a period are local to the preceding global label, as in
+// assembly source.
+func (asm *Assembler) Label(name string) {
+	p := asm.next()
+	p.label(asm.line, token{name, 1})
+}
+
+// Inst adds the instruction op with operands a and b. As in the
+// specification, a is the source operand and b the destination, so
+// Inst("SET", "0x30", "A") adds SET A, 0x30. Extended instructions such as
+// JSR have only an a operand, and b must be empty.
+func (asm *Assembler) Inst(op string, a, b Operand) {
+	args := []token{{string(a), 1}}
+	if b != "" {
+		args = []token{{string(b), 1}, {string(a), 1}}
+	}
+	p := asm.next()
+	p.parseInst(asm.line, token{op, 1}, args)
+}
+
+// Data adds the words to the program, as DAT does.
+func (asm *Assembler) Data(words ...uint16) {
+	p := asm.next()
+	if len(words) == 0 {
+		return
+	}
+	in := &instruction{line: asm.line, data: make([]operand, len(words))}
+	st := Statement{Kind: STMT_DIRECTIVE, Line: asm.line, Col: 1, Op: "DAT", insts: []*instruction{in}}
+	for i, v := range words {
+		in.data[i] = operand{hasNext: true, value: v}
+		st.Args = append(st.Args, Arg{Text: fmt.Sprintf("0x%04x", v), Col: 1})
+	}
+	p.add(st)
+}
+
+// Emit resolves the labels referred to by the program and writes the
+// assembled words to w. If the program contains errors, nothing is written
+// to w and the errors are returned as an ErrorList.
+func (asm *Assembler) Emit(w WordWriter) error {
+	asm.prog.errs = asm.p.errs
+	return asm.prog.Emit(w)
+}
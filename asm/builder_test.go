@@ -0,0 +1,79 @@
+package asm
+
+import (
+	"testing"
+)
+
+func TestAssemblerBuilder(t *testing.T) {
+	var b Assembler
+	b.Inst("SET", "0x30", "A")
+	b.Inst("SET", "0x20", "[0x1000]")
+	b.Inst("SUB", "[0x1000]", "A")
+	b.Inst("IFN", "0x10", "A")
+	b.Inst("SET", "crash", "PC")
+
+	b.Inst("SET", "10", "I")
+	b.Inst("SET", "0x2000", "A")
+	b.Label("loop")
+	b.Inst("SET", "[A]", "[0x2000+I]")
+	b.Inst("SUB", "1", "I")
+	b.Inst("IFN", "0", "I")
+	b.Inst("SET", "loop", "PC")
+
+	b.Inst("SET", "0x4", "X")
+	b.Inst("JSR", "testsub", "")
+	b.Inst("SET", "crash", "PC")
+
+	b.Label("testsub")
+	b.Inst("SHL", "4", "X")
+	b.Inst("SET", "POP", "PC")
+
+	b.Label("crash")
+	b.Inst("SET", "crash", "PC")
+	b.Data(0x1234, 0x5678)
+
+	var got wordBuffer
+	if err := b.Emit(&got); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	want := append(append([]uint16{}, sampleWords...), 0x1234, 0x5678)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d words, got %d: %04x\n", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("0x%04x: got 0x%04x, want 0x%04x\n", i, got[i], want[i])
+		}
+	}
+}
+
+func TestAssemblerBuilderErrors(t *testing.T) {
+	var b Assembler
+	b.Label("start")
+	b.Inst("SET", "nowhere", "PC")
+	b.Inst("SET", "1", "")
+	b.Label("start")
+
+	var got wordBuffer
+	err := b.Emit(&got)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("Expected an ErrorList, got: %v\n", err)
+	}
+	expect := []AssembleError{
+		{2, 1, `undefined label "nowhere"`},
+		{3, 1, "SET takes 2 operands"},
+		{4, 1, `label "start" redefined`},
+	}
+	if len(errs) != len(expect) {
+		t.Fatalf("Expected %d errors, got %d: %v\n", len(expect), len(errs), errs)
+	}
+	for i, e := range expect {
+		if *errs[i] != e {
+			t.Errorf("Expected error %q, got %q\n", e.Error(), errs[i])
+		}
+	}
+	if len(got) != 0 {
+		t.Errorf("Expected no output, got: %04x\n", got)
+	}
+}
@@ -0,0 +1,42 @@
+package asm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AssembleError describes a problem found at a specific location in the
+// assembly source.
+type AssembleError struct {
+	Line int // line number, starting at 1
+	Col  int // column of the offending token, starting at 1
+	Msg  string
+}
+
+func (e *AssembleError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+// ErrorList is the list of errors returned by Assemble when the source
+// contains one or more errors. The errors are ordered by line and column.
+type ErrorList []*AssembleError
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// sort orders the errors by line and column.
+func (l ErrorList) sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		if l[i].Line != l[j].Line {
+			return l[i].Line < l[j].Line
+		}
+		return l[i].Col < l[j].Col
+	})
+}
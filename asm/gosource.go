@@ -0,0 +1,28 @@
+package asm
+
+import (
+	"fmt"
+	"io"
+)
+
+// WriteGoSource writes words to w as a Go []uint16 composite literal, eight
+// words per line, suitable for pasting into a test.
+func WriteGoSource(w io.Writer, words []uint16) error {
+	if _, err := io.WriteString(w, "[]uint16{\n"); err != nil {
+		return err
+	}
+	for i := 0; i < len(words); i += 8 {
+		line := "\t"
+		for j := i; j < i+8 && j < len(words); j++ {
+			if j > i {
+				line += " "
+			}
+			line += fmt.Sprintf("0x%04x,", words[j])
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
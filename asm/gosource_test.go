@@ -0,0 +1,29 @@
+package asm
+
+import (
+	"bytes"
+	goparser "go/parser"
+	"testing"
+)
+
+func TestWriteGoSource(t *testing.T) {
+	words := []uint16{
+		0x7c01, 0x0030, 0x7fc1, 0x0020, 0x1000, 0x7803, 0x1000, 0xc413,
+		0x7f81, 0x001a,
+	}
+	expect := "[]uint16{\n" +
+		"\t0x7c01, 0x0030, 0x7fc1, 0x0020, 0x1000, 0x7803, 0x1000, 0xc413,\n" +
+		"\t0x7f81, 0x001a,\n" +
+		"}\n"
+
+	b := new(bytes.Buffer)
+	if err := WriteGoSource(b, words); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if b.String() != expect {
+		t.Errorf("Expected:\n%s\ngot:\n%s\n", expect, b)
+	}
+	if _, err := goparser.ParseExpr(b.String()); err != nil {
+		t.Errorf("Expected a valid Go expression, got error: %v\n", err)
+	}
+}
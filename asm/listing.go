@@ -0,0 +1,52 @@
+package asm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// AssembleListing assembles the program read from r like Assemble, writing
+// the output to w, and also writes a listing to listing. Each line of the
+// listing is a line of source prefixed by its address and the words it
+// assembled to:
+//
+//	0000: 7c01 0030      SET A, 0x30
+//
+// Lines that assemble to no words, such as blank and comment-only lines,
+// label-only lines and EQU and .use directives, are listed without an
+// address. If the source contains errors, nothing is written to either w or
+// listing.
+func AssembleListing(r io.Reader, w WordWriter, listing io.Writer) error {
+	a, err := assemble(r)
+	if err != nil {
+		return err
+	}
+	if err := a.writeWords(w); err != nil {
+		return err
+	}
+	return a.writeListing(listing)
+}
+
+// writeListing writes the listing of the assembled program to w.
+func (a *assembler) writeListing(w io.Writer) error {
+	words := make(map[int][]uint16) // source line -> assembled words
+	for _, in := range a.insts {
+		words[in.line] = append(words[in.line], in.words...)
+	}
+
+	for i, src := range a.source {
+		prefix := strings.Repeat(" ", 21)
+		if line, ok := words[i+1]; ok {
+			hex := make([]string, len(line))
+			for j, v := range line {
+				hex[j] = fmt.Sprintf("%04x", v)
+			}
+			prefix = fmt.Sprintf("%04x: %-14s ", src.addr, strings.Join(hex, " "))
+		}
+		if _, err := io.WriteString(w, prefix+src.text+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAssembleListing(t *testing.T) {
+	var words wordBuffer
+	listing := new(bytes.Buffer)
+	if err := AssembleListing(strings.NewReader(sample), &words, listing); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(words) != len(sampleWords) {
+		t.Errorf("Expected %d words, got %d\n", len(sampleWords), len(words))
+	}
+
+	src := strings.Split(strings.TrimSuffix(sample, "\n"), "\n")
+	lines := strings.Split(strings.TrimSuffix(listing.String(), "\n"), "\n")
+	if len(lines) != len(src) {
+		t.Fatalf("Expected %d listing lines, got %d\n", len(src), len(lines))
+	}
+
+	addr := 0
+	for i, line := range lines {
+		prefix, text := line[:21], line[21:]
+		if text != src[i] {
+			t.Errorf("line %d: expected source %q, got %q\n", i+1, src[i], text)
+		}
+		if strings.HasPrefix(strings.TrimSpace(text), ";") || text == "" {
+			if strings.TrimSpace(prefix) != "" {
+				t.Errorf("line %d: expected no address, got %q\n", i+1, prefix)
+			}
+			continue
+		}
+
+		// the words must match the line's comment, less any [*] marker
+		comment := text[strings.Index(text, ";")+1:]
+		want := strings.TrimSpace(strings.TrimSuffix(comment, "[*]"))
+		want = fmt.Sprintf("%04x: %-14s", addr, want)
+		if got := strings.TrimRight(prefix, " "); got != strings.TrimRight(want, " ") {
+			t.Errorf("line %d: expected %q, got %q\n", i+1, want, got)
+		}
+		addr += len(strings.Fields(prefix)) - 1
+	}
+}
+
+func TestAssembleListingErrors(t *testing.T) {
+	var words wordBuffer
+	listing := new(bytes.Buffer)
+	if err := AssembleListing(strings.NewReader("SET A, nowhere\n"), &words, listing); err == nil {
+		t.Errorf("Expected an error\n")
+	}
+	if len(words) != 0 || listing.Len() != 0 {
+		t.Errorf("Expected no output, got %d words and %q\n", len(words), listing)
+	}
+}
+
+func TestAssembleListingPushAll(t *testing.T) {
+	var words wordBuffer
+	listing := new(bytes.Buffer)
+	if err := AssembleListing(strings.NewReader("PUSHALL A, B, C\n"), &words, listing); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if e := "0000: 0301 0701 0b01 PUSHALL A, B, C\n"; listing.String() != e {
+		t.Errorf("Expected %q, got %q\n", e, listing)
+	}
+}
+
+func TestAssembleListingNoWords(t *testing.T) {
+	input := ".use lem1802\n" +
+		"count EQU 3\n" +
+		":start\n" +
+		"SET A, count\n"
+	var words wordBuffer
+	listing := new(bytes.Buffer)
+	if err := AssembleListing(strings.NewReader(input), &words, listing); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	blank := strings.Repeat(" ", 21)
+	expect := blank + ".use lem1802\n" +
+		blank + "count EQU 3\n" +
+		blank + ":start\n" +
+		"0000: 7c01 0003      SET A, count\n"
+	if listing.String() != expect {
+		t.Errorf("Expected %q, got %q\n", expect, listing)
+	}
+}
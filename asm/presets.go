@@ -0,0 +1,54 @@
+package asm
+
+// preset is a named value in a built-in constant set.
+type preset struct {
+	name  string
+	value uint16
+}
+
+// presets are the built-in constant sets that a program can define with the
+// .use directive, by name.
+var presets = map[string][]preset{
+	// the LEM1802 display and generic keyboard of the standard console
+	"lem1802": {
+		// LEM1802 interrupt messages
+		{"MEM_MAP_SCREEN", 0}, {"MEM_MAP_FONT", 1}, {"MEM_MAP_PALETTE", 2},
+		{"SET_BORDER_COLOR", 3}, {"MEM_DUMP_FONT", 4}, {"MEM_DUMP_PALETTE", 5},
+
+		// indices into the default LEM1802 palette
+		{"COLOR_BLACK", 0x0}, {"COLOR_DARK_BLUE", 0x1},
+		{"COLOR_DARK_GREEN", 0x2}, {"COLOR_DARK_CYAN", 0x3},
+		{"COLOR_DARK_RED", 0x4}, {"COLOR_DARK_MAGENTA", 0x5},
+		{"COLOR_BROWN", 0x6}, {"COLOR_LIGHT_GRAY", 0x7},
+		{"COLOR_DARK_GRAY", 0x8}, {"COLOR_BLUE", 0x9},
+		{"COLOR_GREEN", 0xa}, {"COLOR_CYAN", 0xb},
+		{"COLOR_RED", 0xc}, {"COLOR_MAGENTA", 0xd},
+		{"COLOR_YELLOW", 0xe}, {"COLOR_WHITE", 0xf},
+
+		// keyboard interrupt messages
+		{"CLEAR_BUFFER", 0}, {"GET_KEY", 1}, {"KEY_PRESSED", 2},
+		{"SET_INTERRUPT", 3},
+
+		// keyboard key codes other than ASCII 0x20-0x7f
+		{"KEY_BACKSPACE", 0x10}, {"KEY_RETURN", 0x11},
+		{"KEY_INSERT", 0x12}, {"KEY_DELETE", 0x13},
+		{"KEY_UP", 0x80}, {"KEY_DOWN", 0x81},
+		{"KEY_LEFT", 0x82}, {"KEY_RIGHT", 0x83},
+		{"KEY_SHIFT", 0x90}, {"KEY_CONTROL", 0x91},
+	},
+}
+
+// use defines the constants in the built-in set named set, as if by an EQU
+// directive for each. Using a set more than once has no further effect.
+func (a *assembler) use(line, col int, set string) {
+	if a.used[set] {
+		return
+	}
+	if a.used == nil {
+		a.used = make(map[string]bool)
+	}
+	a.used[set] = true
+	for _, p := range presets[set] {
+		a.defineConstant(line, col, p.name, operand{hasNext: true, value: p.value})
+	}
+}
@@ -0,0 +1,383 @@
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/markcol/dcpu16/cpu"
+)
+
+// StatementKind identifies the kind of a Statement.
+type StatementKind int
+
+const (
+	STMT_LABEL       StatementKind = iota // label definition, :name
+	STMT_INSTRUCTION                      // instruction, e.g. SET A, 1
+	STMT_DIRECTIVE                        // DAT, RESW, EQU or .use
+)
+
+// Statement is a single label, instruction or directive of a program. A line
+// of source may hold more than one statement, such as a label followed by an
+// instruction.
+type Statement struct {
+	Kind StatementKind
+	Line int    // line number, starting at 1
+	Col  int    // column of the label, mnemonic or constant name
+	Name string // label or EQU constant name; local labels are qualified
+	Op   string // mnemonic or directive as written; empty for labels
+	Args []Arg  // operands in source order, so b comes before a
+
+	insts []*instruction // parsed instructions, DAT or RESW
+	equ   *operand       // value of an EQU constant
+	set   string         // constant set named by .use
+}
+
+// Arg is an operand of a Statement.
+type Arg struct {
+	Text   string // as written, e.g. "[0x2000+I]"
+	Col    int    // column, starting at 1
+	Symbol string // label or constant referred to, if any
+}
+
+// Program is a program parsed by ParseProgram. Its statements have no
+// addresses until Resolve is called.
+type Program struct {
+	Statements []Statement
+	source     []sourceLine
+	errs       ErrorList  // errors found while parsing
+	a          *assembler // the result of the last Resolve
+}
+
+// ParseProgram parses the program read from r into a list of statements
+// without assigning addresses or resolving labels, for tools such as editors
+// that need the structure of the source. Resolve and Emit complete the
+// assembly. If the source contains syntax errors, the lines containing them
+// are skipped and the errors are returned as an ErrorList along with the
+// statements that could be parsed.
+func ParseProgram(r io.Reader) (*Program, error) {
+	prog := &Program{}
+	p := &parser{prog: prog}
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		// the last line need not end with a newline
+		text, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if text == "" && err == io.EOF {
+			break
+		}
+		text = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+		prog.source = append(prog.source, sourceLine{text: text})
+		p.parseLine(line, text)
+		if err == io.EOF {
+			break
+		}
+	}
+	prog.errs = p.errs
+	if len(prog.errs) > 0 {
+		prog.errs.sort()
+		return prog, prog.errs
+	}
+	return prog, nil
+}
+
+// Resolve assigns an address to each statement, defines the labels and
+// constants and resolves references to them, assembling each instruction.
+// The errors found by ParseProgram and by Resolve are returned as an
+// ErrorList ordered by line and column.
+func (p *Program) Resolve() error {
+	p.a = layout(p)
+	if len(p.a.errs) > 0 {
+		return p.a.errs
+	}
+	return nil
+}
+
+// Emit resolves the program and writes the assembled words to w. If the
+// program contains errors, nothing is written to w and the errors are
+// returned as an ErrorList.
+func (p *Program) Emit(w WordWriter) error {
+	if err := p.Resolve(); err != nil {
+		return err
+	}
+	return p.a.writeWords(w)
+}
+
+// CheckJumpTargets returns a warning for each jump whose target is the
+// address of an operand word of another instruction rather than the start of
+// an instruction, which is usually a misplaced label. The jumps checked are
+// SET PC, JSR and IAS with a label or constant as the target. Each warning
+// gives the position of the target in the jump, its name and address, and
+// the address of the instruction it falls inside. The program must have been
+// resolved without errors; otherwise no warnings are returned.
+func (p *Program) CheckJumpTargets() ErrorList {
+	if p.a == nil || len(p.a.errs) > 0 {
+		return nil
+	}
+	var warnings ErrorList
+	for _, in := range p.a.insts {
+		if !isJump(in) || in.a.symbol == "" {
+			continue
+		}
+		target := p.a.value(in, in.a)
+		for _, other := range p.a.insts {
+			if other.data == nil && target > other.addr && target < other.addr+other.size() {
+				warnings = append(warnings, &AssembleError{in.line, in.a.col, fmt.Sprintf(
+					"jump target %q (0x%04x) is inside the instruction at 0x%04x",
+					in.a.symbol, target, other.addr)})
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+// isJump reports whether in jumps to the address given by its a operand.
+func isJump(in *instruction) bool {
+	if in.a.mode != 0x1f {
+		return false // not a literal address
+	}
+	if in.opcode == cpu.EXT {
+		return in.ext == cpu.JSR || in.ext == cpu.IAS
+	}
+	return in.opcode == cpu.SET && in.b.mode == 0x1c
+}
+
+// parser holds the state of parsing a single program.
+type parser struct {
+	prog  *Program
+	scope string // the last global label, which scopes local labels
+	errs  ErrorList
+}
+
+// errorf records an error at the given line and column.
+func (p *parser) errorf(line, col int, format string, args ...interface{}) {
+	p.errs = append(p.errs, &AssembleError{line, col, fmt.Sprintf(format, args...)})
+}
+
+// add adds st to the program.
+func (p *parser) add(st Statement) {
+	p.prog.Statements = append(p.prog.Statements, st)
+}
+
+// parseLine parses a single line of source. A line consists of an optional
+// :label, an optional instruction and an optional ; comment, or of a constant
+// definition of the form "name EQU value". Labels that begin with a period,
+// such as .loop, are local to the preceding global label, and are stored and
+// may be referred to elsewhere as global.loop. The directive ".use set"
+// defines the constants in a built-in set, such as lem1802.
+func (p *parser) parseLine(line int, text string) {
+	text = stripComment(text)
+	i := skipSpace(text, 0)
+
+	if i < len(text) && text[i] != ':' {
+		j := skipToken(text, i)
+		k := skipSpace(text, j)
+		if l := skipToken(text, k); strings.ToUpper(text[k:l]) == "EQU" {
+			p.parseEqu(line, token{text[i:j], i + 1}, token{text[k:l], k + 1}, splitArgs(text, l))
+			return
+		}
+	}
+
+	if i < len(text) && text[i] == ':' {
+		j := skipToken(text, i)
+		p.label(line, token{text[i+1 : j], i + 1})
+		i = skipSpace(text, j)
+	}
+	if i == len(text) {
+		return
+	}
+
+	j := skipToken(text, i)
+	p.parseInst(line, token{text[i:j], i + 1}, splitArgs(text, j))
+}
+
+// label adds the definition of the label name. A name that begins with a
+// period is local to the preceding global label.
+func (p *parser) label(line int, name token) {
+	if strings.HasPrefix(name.text, ".") {
+		name.text = p.scope + name.text
+	} else {
+		p.scope = name.text
+	}
+	if name.text == "" {
+		p.errorf(line, name.col, "missing label name")
+		return
+	}
+	p.add(Statement{Kind: STMT_LABEL, Line: line, Col: name.col, Name: name.text})
+}
+
+// parseInst parses an instruction or directive with the given operands and
+// adds it to the program.
+func (p *parser) parseInst(line int, mnemonic token, args []token) {
+	in := &instruction{line: line}
+	var err error
+	var bad token // the operand being parsed when err occurred
+	kind := STMT_INSTRUCTION
+	name := strings.ToUpper(mnemonic.text)
+	if name == "DAT" {
+		if len(args) == 0 {
+			p.errorf(line, mnemonic.col, "DAT requires at least one value")
+			return
+		}
+		kind = STMT_DIRECTIVE
+		in.data, bad, err = parseData(args)
+	} else if name == "RESW" {
+		if len(args) != 1 {
+			p.errorf(line, mnemonic.col, "RESW takes 1 operand")
+			return
+		}
+		kind = STMT_DIRECTIVE
+		in.data, err = parseReserve(args[0].text)
+		bad = args[0]
+	} else if name == ".USE" {
+		p.parseUse(line, mnemonic, args)
+		return
+	} else if name == "PUSHALL" || name == "POPALL" {
+		p.parseRegisterList(line, mnemonic, args, name == "POPALL")
+		return
+	} else if op, ok := basicOpcodes[name]; ok {
+		if len(args) != 2 {
+			p.errorf(line, mnemonic.col, "%s takes 2 operands", mnemonic.text)
+			return
+		}
+		in.opcode = op
+		bad = args[0]
+		if in.b, err = parseOperand(args[0], false); err == nil {
+			bad = args[1]
+			in.a, err = parseOperand(args[1], true)
+		}
+	} else if op, ok := extOpcodes[name]; ok {
+		if len(args) != 1 {
+			p.errorf(line, mnemonic.col, "%s takes 1 operand", mnemonic.text)
+			return
+		}
+		in.opcode = cpu.EXT
+		in.ext = op
+		bad = args[0]
+		in.a, err = parseOperand(args[0], true)
+	} else {
+		p.errorf(line, mnemonic.col, "unknown opcode %q", mnemonic.text)
+		return
+	}
+	if err != nil {
+		p.errorf(line, bad.col, "%v", err)
+		return
+	}
+	p.qualify(&in.a)
+	p.qualify(&in.b)
+	for i := range in.data {
+		p.qualify(&in.data[i])
+	}
+	p.add(Statement{
+		Kind:  kind,
+		Line:  line,
+		Col:   mnemonic.col,
+		Op:    mnemonic.text,
+		Args:  p.args(args),
+		insts: []*instruction{in},
+	})
+}
+
+// parseRegisterList expands the pseudo-instruction PUSHALL, or POPALL if pop
+// is true, into one SET PUSH, reg for each register in args, in order, or one
+// SET reg, POP for each register in reverse order, so that POPALL with the
+// same list restores the registers saved by PUSHALL.
+func (p *parser) parseRegisterList(line int, mnemonic token, args []token, pop bool) {
+	if len(args) == 0 {
+		p.errorf(line, mnemonic.col, "%s requires at least one register", mnemonic.text)
+		return
+	}
+	regs := make([]uint16, len(args))
+	for i, arg := range args {
+		r, ok := registers[strings.ToUpper(arg.text)]
+		if !ok {
+			p.errorf(line, arg.col, "%s operand %q is not a register", mnemonic.text, arg.text)
+			return
+		}
+		regs[i] = r
+	}
+	st := Statement{Kind: STMT_INSTRUCTION, Line: line, Col: mnemonic.col, Op: mnemonic.text, Args: p.args(args)}
+	for i := range regs {
+		in := &instruction{line: line, opcode: cpu.SET}
+		if pop {
+			in.b, in.a = operand{mode: regs[len(regs)-1-i]}, operand{mode: 0x18}
+		} else {
+			in.b, in.a = operand{mode: 0x18}, operand{mode: regs[i]}
+		}
+		st.insts = append(st.insts, in)
+	}
+	p.add(st)
+}
+
+// parseEqu parses the definition of constant name with the given value.
+func (p *parser) parseEqu(line int, name, equ token, args []token) {
+	if len(args) != 1 {
+		p.errorf(line, name.col, "EQU takes 1 value")
+		return
+	}
+	o, err := parseValue(args[0].text)
+	if err != nil {
+		p.errorf(line, args[0].col, "%v", err)
+		return
+	}
+	o.col = args[0].col
+	p.qualify(&o)
+	p.add(Statement{
+		Kind: STMT_DIRECTIVE,
+		Line: line,
+		Col:  name.col,
+		Name: name.text,
+		Op:   equ.text,
+		Args: []Arg{{Text: args[0].text, Col: args[0].col, Symbol: o.symbol}},
+		equ:  &o,
+	})
+}
+
+// parseUse parses a .use directive naming a built-in constant set.
+func (p *parser) parseUse(line int, directive token, args []token) {
+	if len(args) != 1 {
+		p.errorf(line, directive.col, "%s takes 1 operand", directive.text)
+		return
+	}
+	set := strings.ToLower(args[0].text)
+	if _, ok := presets[set]; !ok {
+		p.errorf(line, args[0].col, "unknown constant set %q", args[0].text)
+		return
+	}
+	p.add(Statement{
+		Kind: STMT_DIRECTIVE,
+		Line: line,
+		Col:  directive.col,
+		Op:   directive.text,
+		Args: []Arg{{Text: args[0].text, Col: args[0].col}},
+		set:  set,
+	})
+}
+
+// qualify prefixes a reference to a local label in o with the current scope.
+func (p *parser) qualify(o *operand) {
+	if strings.HasPrefix(o.symbol, ".") {
+		o.symbol = p.scope + o.symbol
+	}
+}
+
+// args returns the operands toks as Args, with the label or constant that
+// each refers to.
+func (p *parser) args(toks []token) []Arg {
+	args := make([]Arg, len(toks))
+	for i, t := range toks {
+		args[i] = Arg{Text: t.text, Col: t.col}
+		if strings.HasPrefix(t.text, "\"") {
+			continue // a string, which refers to nothing
+		}
+		if o, err := parseMode(t.text, true); err == nil {
+			p.qualify(&o)
+			args[i].Symbol = o.symbol
+		}
+	}
+	return args
+}
@@ -0,0 +1,131 @@
+package asm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProgram(t *testing.T) {
+	p, err := ParseProgram(strings.NewReader(sample))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(p.Statements) != 20 {
+		t.Fatalf("Expected 20 statements, got %d\n", len(p.Statements))
+	}
+
+	counts := map[StatementKind]int{}
+	var labels []string
+	for _, st := range p.Statements {
+		counts[st.Kind]++
+		if st.Kind == STMT_LABEL {
+			labels = append(labels, st.Name)
+		}
+	}
+	if counts[STMT_LABEL] != 3 || counts[STMT_INSTRUCTION] != 17 || counts[STMT_DIRECTIVE] != 0 {
+		t.Errorf("Expected 3 labels and 17 instructions, got %v\n", counts)
+	}
+	if strings.Join(labels, " ") != "loop testsub crash" {
+		t.Errorf("Expected labels loop, testsub and crash, got %v\n", labels)
+	}
+
+	st := p.Statements[0]
+	if st.Kind != STMT_INSTRUCTION || st.Line != 2 || st.Op != "SET" || len(st.Args) != 2 ||
+		st.Args[0].Text != "A" || st.Args[1].Text != "0x30" {
+		t.Errorf("Expected SET A, 0x30 on line 2, got %+v\n", st)
+	}
+	st = p.Statements[4]
+	if st.Op != "SET" || len(st.Args) != 2 || st.Args[1].Symbol != "crash" {
+		t.Errorf("Expected SET PC, crash to refer to crash, got %+v\n", st)
+	}
+
+	var b wordBuffer
+	if err := p.Emit(&b); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(b) != len(sampleWords) {
+		t.Fatalf("Expected %d words, got %d\n", len(sampleWords), len(b))
+	}
+	for i := range sampleWords {
+		if b[i] != sampleWords[i] {
+			t.Errorf("0x%04x: got 0x%04x, want 0x%04x\n", i, b[i], sampleWords[i])
+		}
+	}
+}
+
+func TestParseProgramDirectives(t *testing.T) {
+	input := ".use lem1802\n" +
+		"size EQU 2\n" +
+		":data DAT size, \"hi\"\n" +
+		":.buf RESW 4\n"
+	p, err := ParseProgram(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	expect := []struct {
+		kind StatementKind
+		name string
+		op   string
+	}{
+		{STMT_DIRECTIVE, "", ".use"},
+		{STMT_DIRECTIVE, "size", "EQU"},
+		{STMT_LABEL, "data", ""},
+		{STMT_DIRECTIVE, "", "DAT"},
+		{STMT_LABEL, "data.buf", ""},
+		{STMT_DIRECTIVE, "", "RESW"},
+	}
+	if len(p.Statements) != len(expect) {
+		t.Fatalf("Expected %d statements, got %d\n", len(expect), len(p.Statements))
+	}
+	for i, e := range expect {
+		st := p.Statements[i]
+		if st.Kind != e.kind || st.Name != e.name || st.Op != e.op {
+			t.Errorf("Statement %d: expected %v %q %q, got %v %q %q\n", i, e.kind, e.name, e.op, st.Kind, st.Name, st.Op)
+		}
+	}
+	if p.Statements[3].Args[0].Symbol != "size" {
+		t.Errorf("Expected DAT size to refer to size, got %q\n", p.Statements[3].Args[0].Symbol)
+	}
+}
+
+func TestParseProgramErrors(t *testing.T) {
+	input := "SET A, 1\n" +
+		"FOO A\n" +
+		"SET PC, nowhere\n"
+	p, err := ParseProgram(strings.NewReader(input))
+	if _, ok := err.(ErrorList); !ok {
+		t.Fatalf("Expected an ErrorList, got: %v\n", err)
+	}
+	if len(p.Statements) != 2 {
+		t.Errorf("Expected the 2 valid statements, got %d\n", len(p.Statements))
+	}
+
+	// undefined labels are found by Resolve
+	err = p.Resolve()
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 2 || errs[1].Msg != `undefined label "nowhere"` {
+		t.Errorf("Expected the unknown opcode and undefined label, got: %v\n", err)
+	}
+}
+
+func TestCheckJumpTargets(t *testing.T) {
+	input := ":start SET [0x1000], 0x20\n" +
+		"middle EQU 0x0001    ; the 0x20 operand word of the SET\n" +
+		"       SET PC, middle\n" +
+		"       JSR start\n"
+	p, err := ParseProgram(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := p.Resolve(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	warnings := p.CheckJumpTargets()
+	expect := AssembleError{3, 16, `jump target "middle" (0x0001) is inside the instruction at 0x0000`}
+	if len(warnings) != 1 {
+		t.Fatalf("Expected 1 warning, got %d: %v\n", len(warnings), warnings)
+	}
+	if *warnings[0] != expect {
+		t.Errorf("Expected warning %q, got %q\n", expect.Error(), warnings[0])
+	}
+}
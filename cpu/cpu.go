@@ -1,7 +1,14 @@
 package cpu
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
 	"math"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,8 +19,22 @@ const (
 	CYCLERATE            = 1000                    // instructions/second
 	INSTRUCTION_DURATION = time.Second / CYCLERATE // duration of an instruction
 	MAX_INTQUEUE         = 256
+	MAX_STEPOVER         = 1 << 20 // instructions run by StepOver/StepOut
+	MAX_LOOP             = 16      // longest loop detected by Halted
 )
 
+// ErrTooManyDevices is returned by AttachHardware when 0xffff devices, the
+// most that HWN can report, are already attached.
+var ErrTooManyDevices = errors.New("too many hardware devices")
+
+// ErrInterruptQueueFull is returned by TriggerInterrupt when MAX_INTQUEUE
+// interrupts are already queued.
+var ErrInterruptQueueFull = errors.New("interrupt queue full")
+
+// ErrNoReturn is returned by StepOver and StepOut when the subroutine does not
+// return within MAX_STEPOVER instructions.
+var ErrNoReturn = errors.New("subroutine did not return")
+
 // OPCODE constants
 const (
 	EXT = iota // Extended Opcode pseudo opcode
@@ -110,18 +131,143 @@ const (
 // ensuring that the state returned is consistent and atomic with respect to
 // the virtual CPU instruction cycle.
 type DCPU16 struct {
-	register    [8]uint16
-	memory      [RAMSIZE]uint16
-	pc          uint16
-	sp          uint16
-	ex          uint16
-	ia          uint16
-	tick        uint16
-	intQueueing bool // true if interrupts are to be queued
-	intQueue    []uint16
-	tmpa        uint16
-	tmpb        uint16
-	mutex       sync.Mutex
+	register      [8]uint16
+	memory        [RAMSIZE]uint16
+	pc            uint16
+	sp            uint16
+	ex            uint16
+	ia            uint16
+	tick          uint16
+	cycles        uint64           // cumulative cycle count, never rolls over
+	intQueueing   bool             // true if interrupts are to be queued
+	intQueue      []uint16         // guarded by intMutex
+	intMutex      sync.Mutex       // devices may queue interrupts at any time
+	overflowFunc  func(queued int) // guarded by intMutex
+	tmpa          uint16
+	tmpb          uint16
+	period        time.Duration // duration of one cycle, 0 = INSTRUCTION_DURATION
+	unlimited     bool          // clock rate set to 0: no period to keep to
+	unthrottled   bool          // realtime off: run as fast as possible
+	epoch         time.Time     // wall-clock time the simulated clock started
+	simulated     time.Duration // simulated time elapsed since epoch
+	skew          time.Duration // time behind the simulated clock
+	instPC        uint16        // address of the instruction being executed
+	faultFunc     func(*Fault)
+	traceFunc     func(pc, opcode uint16)
+	traceWriter   io.Writer
+	trapPCWrap    bool // fault when PC wraps around during instruction fetch
+	trapDivZero   bool // fault on DIV, DVI, MOD, MDI by zero
+	name          string
+	debugInfo     map[uint16]SourceLine
+	hardware      []Device            // attached devices, in hardware index order
+	stop          bool                // set by Stop to make Run return
+	caughtFire    bool                // the interrupt queue overflowed; the CPU is halted
+	halted        bool                // the CPU is in a loop it can never leave
+	haltPC        uint16              // address at which the halted loop is entered
+	changed       bool                // the last instruction changed memory or hardware
+	loop          [MAX_LOOP]loopState // recent states, for loop detection
+	loopLen       int                 // number of states in loop
+	loopNext      int                 // index in loop of the next state
+	leaAddr       int                 // memory address resolved by lea, or -1
+	mappings      []mapping
+	breakpoints   map[uint16]bool
+	watchpoints   map[uint16]WatchKind
+	watchHit      bool // a watchpoint fired during the last instruction
+	lastWatchAddr uint16
+	lastWatchKind WatchKind
+	last          StepResult
+	mutex         sync.Mutex
+}
+
+// Device is a hardware device that can be attached to the CPU with
+// AttachHardware. Interrupt is called when the CPU executes an HWI for the
+// device; it is called with the CPU locked, in the middle of the HWI
+// instruction, so it must not call any methods on the CPU that wait for an
+// instruction boundary. Interrupt returns the number of cycles the interrupt
+// takes in addition to the 4 cycles of the HWI instruction itself.
+type Device interface {
+	ID() uint32           // hardware ID, returned by HWQ in A and B
+	Version() uint16      // hardware version, returned by HWQ in C
+	Manufacturer() uint32 // manufacturer ID, returned by HWQ in X and Y
+	Interrupt(c *DCPU16) uint16
+}
+
+// MappedDevice is a device that is accessed through a range of memory
+// addresses rather than with HWI, attached to the CPU with MapDevice.
+// WriteWord is called when an instruction writes val to addr, and ReadWord
+// supplies the value of addr when an instruction reads it. Both are called
+// with the CPU locked, so they must not call any methods on the CPU that wait
+// for an instruction boundary.
+type MappedDevice interface {
+	WriteWord(addr, val uint16)
+	ReadWord(addr uint16) uint16
+}
+
+// WatchKind is the kind of memory access that triggers a watchpoint.
+type WatchKind int
+
+// Watchpoint kinds
+const (
+	WATCH_READ WatchKind = 1 << iota
+	WATCH_WRITE
+)
+
+// loopState is a state of the CPU recorded to detect stationary loops: a
+// hash of the registers after an instruction, and the PC.
+type loopState struct {
+	hash uint64
+	pc   uint16
+}
+
+// mapping is a range of memory registered with MapMemory, MapMemoryRead or
+// MapDevice. Either of onWrite and onRead may be nil.
+type mapping struct {
+	lo, hi  uint16
+	onWrite func(addr, val uint16)
+	onRead  func(addr uint16) uint16
+}
+
+// StepResult describes an executed instruction.
+type StepResult struct {
+	PC        uint16 // address of the instruction
+	Opcode    uint16 // basic opcode, or EXT for an extended instruction
+	ExtOpcode uint16 // extended opcode, if Opcode is EXT
+	A, B      uint16 // operand values before execution; B is 0 if Opcode is EXT
+	Cycles    int    // cycles consumed, including any skipped instruction
+	Skipped   bool   // true if a failed conditional skipped the next instruction
+	Illegal   bool   // true if the opcode is undefined; it had no effect
+}
+
+// Fault describes an abnormal condition detected while executing an
+// instruction. Faults are reported to the function installed with
+// SetFaultFunc.
+type Fault struct {
+	Name   string // name of the CPU, if set with SetName
+	PC     uint16 // address of the faulting instruction
+	Reason string
+	Source SourceLine // source of the instruction, if debug info is loaded
+}
+
+func (f *Fault) Error() string {
+	s := fmt.Sprintf("fault at 0x%04x: %s", f.PC, f.Reason)
+	if f.Name != "" {
+		s = f.Name + ": " + s
+	}
+	if f.Source.Line > 0 {
+		s += fmt.Sprintf(" (%s)", f.Source)
+	}
+	return s
+}
+
+// SourceLine identifies the line of source an instruction was assembled
+// from.
+type SourceLine struct {
+	File string
+	Line int
+}
+
+func (l SourceLine) String() string {
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
 }
 
 func NewDCPU16() *DCPU16 {
@@ -132,42 +278,199 @@ func NewDCPU16() *DCPU16 {
 }
 
 // Write writes the words from the slice data into memory starting at the
-// address in addr. Any existing data will be overwritten.
-// If addr + len(data) > MEMSIZE, only MEMSIZE-addr+1 words will be copied.
-func (c *DCPU16) Write(addr uint16, data []uint16) {
+// address in addr and returns the number of words written. Any existing data
+// will be overwritten. If addr + len(data) > RAMSIZE, only RAMSIZE-addr words
+// will be written.
+func (c *DCPU16) Write(addr uint16, data []uint16) int {
 	// wait for an instruction boundary
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	copy(c.memory[addr:], data)
+	c.forgetLoop()
+	return copy(c.memory[addr:], data)
 }
 
 // Read reads (at most) len words from memory starting at the given address and
 // returns them to the caller. The number of words returned may be less than
 // requested if address + len exceeds addressable memory.
 func (c *DCPU16) Read(addr uint16, l int) []uint16 {
-	// wait for an instruction boundary
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
 	if int(addr)+l > LASTADDR {
 		l = LASTADDR - int(addr) + 1
 	}
 	d := make([]uint16, l)
-	copy(d, c.memory[addr:])
+	c.ReadInto(addr, d)
 	return d
 }
 
+// ReadInto fills dst with words from memory starting at the given address and
+// returns the number of words copied, which may be less than len(dst) if the
+// end of addressable memory is reached. Unlike Read, it does not allocate.
+func (c *DCPU16) ReadInto(addr uint16, dst []uint16) int {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return copy(dst, c.memory[addr:])
+}
+
+// Peek returns the word of memory at addr.
+func (c *DCPU16) Peek(addr uint16) uint16 {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.memory[addr]
+}
+
+// Poke sets the word of memory at addr to val.
+func (c *DCPU16) Poke(addr, val uint16) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.forgetLoop()
+	c.memory[addr] = val
+}
+
+// Stack returns up to depth words from the top of the stack, starting at SP.
+// The stack grows down from the top of memory, so it holds 0x10000-SP words
+// (none when SP is 0), and fewer than depth are returned if it holds fewer.
+func (c *DCPU16) Stack(depth int) []uint16 {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if n := (RAMSIZE - int(c.sp)) % RAMSIZE; depth > n {
+		depth = n
+	}
+	if depth < 0 {
+		depth = 0
+	}
+	s := make([]uint16, depth)
+	copy(s, c.memory[c.sp:])
+	return s
+}
+
+// UsedRegions returns the inclusive [start, end] address ranges of non-zero
+// memory, in ascending order. Runs of zero words shorter than threshold that
+// separate two regions are coalesced into a single region.
+func (c *DCPU16) UsedRegions(threshold int) [][2]uint16 {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.usedRegions(threshold)
+}
+
+// usedRegions is UsedRegions for a CPU that is already locked.
+func (c *DCPU16) usedRegions(threshold int) [][2]uint16 {
+	var r [][2]uint16
+	for i := 0; i < RAMSIZE; i++ {
+		if c.memory[i] == 0 {
+			continue
+		}
+		if n := len(r); n > 0 {
+			// number of zero words between the last region and i
+			if gap := i - int(r[n-1][1]) - 1; gap == 0 || gap < threshold {
+				r[n-1][1] = uint16(i)
+				continue
+			}
+		}
+		r = append(r, [2]uint16{uint16(i), uint16(i)})
+	}
+	return r
+}
+
+// Fingerprint returns a stable 32-bit FNV-1a hash of the length words of mem
+// starting at start, clamped to the end of mem. It can be used to check that a
+// program was assembled or loaded as expected.
+func Fingerprint(mem []uint16, start, length uint16) uint32 {
+	end := int(start) + int(length)
+	if end > len(mem) {
+		end = len(mem)
+	}
+	h := fnv.New32a()
+	for i := int(start); i < end; i++ {
+		hashWord(h, mem[i])
+	}
+	return h.Sum32()
+}
+
+// Fingerprint returns a stable 32-bit FNV-1a hash of the used regions of
+// memory (see UsedRegions), including their addresses.
+func (c *DCPU16) Fingerprint() uint32 {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	h := fnv.New32a()
+	for _, r := range c.usedRegions(0) {
+		hashWord(h, r[0])
+		hashWord(h, r[1])
+		for i := int(r[0]); i <= int(r[1]); i++ {
+			hashWord(h, c.memory[i])
+		}
+	}
+	return h.Sum32()
+}
+
+// StateHash returns a 64-bit FNV-1a hash of the registers, interrupt state
+// and all of memory. Two CPUs that execute the same program from the same
+// state have the same hash, which makes it a cheap check for deterministic
+// replay.
+func (c *DCPU16) StateHash() uint64 {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	h := fnv.New64a()
+	for _, v := range c.register {
+		hashWord(h, v)
+	}
+	for _, v := range []uint16{c.pc, c.sp, c.ex, c.ia, c.tick} {
+		hashWord(h, v)
+	}
+	if c.intQueueing {
+		hashWord(h, 1)
+	} else {
+		hashWord(h, 0)
+	}
+	c.intMutex.Lock()
+	hashWord(h, uint16(len(c.intQueue)))
+	for _, v := range c.intQueue {
+		hashWord(h, v)
+	}
+	c.intMutex.Unlock()
+	for _, v := range c.memory {
+		hashWord(h, v)
+	}
+	return h.Sum64()
+}
+
+// hashWord adds the big-endian bytes of w to h.
+func hashWord(h hash.Hash, w uint16) {
+	h.Write([]byte{byte(w >> 8), byte(w)})
+}
+
 // Registers returns a slice of words with the values of the current CPU
 // registers and pseudo-registers. The registers are stored in the following
 // order: a, b, c, x, y, z, i, j, pc, sp, ex, ia, tick, iq.
 func (c *DCPU16) Registers() []uint16 {
+	r := make([]uint16, regSize)
+	c.RegistersInto(r)
+	return r
+}
+
+// RegistersInto copies the registers, in the order used by Registers, into
+// dst and returns the number of words copied, which is less than regSize if
+// dst is too short. Unlike Registers, it does not allocate.
+func (c *DCPU16) RegistersInto(dst []uint16) int {
 	// wait for an instruction boundary
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	r := make([]uint16, regSize)
-	copy(r, c.register[:])
+	var r [regSize]uint16
+	copy(r[:], c.register[:])
 	r[PC] = c.pc
 	r[SP] = c.sp
 	r[EX] = c.ex
@@ -175,43 +478,596 @@ func (c *DCPU16) Registers() []uint16 {
 	r[TICK] = c.tick
 	if c.intQueueing {
 		r[IQ] = 1
-	} else {
-		r[IQ] = 0
 	}
-	return r
+	return copy(dst, r[:])
+}
+
+// GetRegister returns the value of the register with the given name: one of
+// "A", "B", "C", "X", "Y", "Z", "I", "J", "PC", "SP", "EX" or "IA". Names are
+// case insensitive. ok is false if there is no such register.
+func (c *DCPU16) GetRegister(name string) (v uint16, ok bool) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if r := c.namedRegister(name); r != nil {
+		return *r, true
+	}
+	return 0, false
+}
+
+// SetRegister sets the register with the given name, as accepted by
+// GetRegister, to v. It returns false if there is no such register.
+func (c *DCPU16) SetRegister(name string, v uint16) bool {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if r := c.namedRegister(name); r != nil {
+		*r = v
+		return true
+	}
+	return false
+}
+
+// namedRegister returns a pointer to the register with the given name, or
+// nil if there is no such register.
+func (c *DCPU16) namedRegister(name string) *uint16 {
+	switch name = strings.ToUpper(name); name {
+	case "PC":
+		return &c.pc
+	case "SP":
+		return &c.sp
+	case "EX":
+		return &c.ex
+	case "IA":
+		return &c.ia
+	}
+	if i := strings.Index("ABCXYZIJ", name); len(name) == 1 && i >= 0 {
+		return &c.register[i]
+	}
+	return nil
+}
+
+// SetName sets the name used to identify the CPU in faults when several
+// CPUs are running.
+func (c *DCPU16) SetName(name string) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.name = name
+}
+
+// Name returns the name of the CPU set with SetName.
+func (c *DCPU16) Name() string {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.name
+}
+
+// Reset returns the CPU to its initial state: all registers, the interrupt
+// queue, memory, the cycle count and timing skew are cleared, as is any
+// pending Stop. Settings such as the name, fault function and attached
+// hardware are kept.
+func (c *DCPU16) Reset() {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.register = [8]uint16{}
+	c.memory = [RAMSIZE]uint16{}
+	c.pc, c.sp, c.ex, c.ia, c.tick = 0, 0, 0, 0, 0
+	c.cycles = 0
+	c.stop = false
+	c.intMutex.Lock()
+	c.intQueue = c.intQueue[:0]
+	c.intMutex.Unlock()
+	c.intQueueing = false
+	c.caughtFire = false
+	c.halted = false
+	c.forgetLoop()
+	c.resetClock()
+}
+
+// AttachHardware attaches d to the CPU and returns its hardware index.
+// Devices are numbered in the order they are attached, starting from 0.
+func (c *DCPU16) AttachHardware(d Device) (index uint16, err error) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.hardware) >= LASTADDR {
+		return 0, ErrTooManyDevices
+	}
+	c.hardware = append(c.hardware, d)
+	return uint16(len(c.hardware) - 1), nil
+}
+
+// MapMemory registers onWrite to be called whenever an instruction writes
+// to an address in [lo, hi]. onWrite is called after the value has been
+// stored, before the instruction completes, with the address and the value
+// written. It is called with the CPU locked, so it must not call any methods
+// on the CPU that wait for an instruction boundary.
+func (c *DCPU16) MapMemory(lo, hi uint16, onWrite func(addr, val uint16)) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.mappings = append(c.mappings, mapping{lo: lo, hi: hi, onWrite: onWrite})
+}
+
+// MapMemoryRead registers onRead to supply the value of an address in
+// [lo, hi] whenever an instruction reads it, so that memory-mapped input
+// devices can provide fresh data (e.g. the next byte received) on each read.
+// The value returned is used in place of the contents of memory, which are
+// not changed. Instructions that only write an address, such as SET, do not
+// call onRead; a value written to a mapped address is stored in memory as
+// usual, and reported to any function registered with MapMemory. If ranges
+// overlap, the function registered first is used. onRead is called with the
+// CPU locked, so it must not call any methods on the CPU that wait for an
+// instruction boundary.
+func (c *DCPU16) MapMemoryRead(lo, hi uint16, onRead func(addr uint16) uint16) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.mappings = append(c.mappings, mapping{lo: lo, hi: hi, onRead: onRead})
+}
+
+// MapDevice maps d to the addresses in [lo, hi], as if by MapMemory with
+// d.WriteWord and MapMemoryRead with d.ReadWord.
+func (c *DCPU16) MapDevice(lo, hi uint16, d MappedDevice) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.mappings = append(c.mappings, mapping{lo: lo, hi: hi, onWrite: d.WriteWord, onRead: d.ReadWord})
+}
+
+// SetTraceFunc installs f to be called before each instruction is executed
+// with the address of the instruction and its first word. A nil f disables
+// tracing. f is called with the CPU locked, so it must not call any methods
+// on the CPU that wait for an instruction boundary.
+func (c *DCPU16) SetTraceFunc(f func(pc, opcode uint16)) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.traceFunc = f
+}
+
+// SetTraceWriter makes the CPU write a line to w before each instruction is
+// executed, giving the CPU's name (if set with SetName), the address of the
+// instruction and its disassembly (e.g. "cpu1: 0x0000: SET A, 0x30"). A nil w
+// disables the trace output.
+func (c *DCPU16) SetTraceWriter(w io.Writer) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.traceWriter = w
+}
+
+// trace writes the trace line for the instruction at the PC to the trace
+// writer. The CPU must be locked.
+func (c *DCPU16) trace() {
+	line := fmt.Sprintf("0x%04x: %s\n", c.pc, c.decodeAt(c.pc))
+	if c.name != "" {
+		line = c.name + ": " + line
+	}
+	io.WriteString(c.traceWriter, line)
+}
+
+// CaughtFire reports whether the CPU has halted because an INT instruction
+// overflowed the interrupt queue. A CPU that has caught fire executes no
+// further instructions until Reset is called.
+func (c *DCPU16) CaughtFire() bool {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.caughtFire
+}
+
+// Halted reports whether the CPU is in a loop that it can never exit, so
+// that Run returns when it is detected. This is the case when the last
+// instruction executed was a SET PC to its own address with interrupts
+// disabled (IA is 0), such as the common ":crash SET PC, crash" idiom for
+// ending a program, or when, with interrupts disabled, the registers return
+// to a state they were in within the last MAX_LOOP instructions without any
+// instruction in between changing memory, queuing or sending an interrupt
+// or reading an address mapped with MapMemoryRead. Changes made by the host,
+// such as with Write, also restart the detection.
+func (c *DCPU16) Halted() bool {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.halted
+}
+
+// HaltedAt returns the address at which the CPU entered the loop in which it
+// halted and true, or false if the CPU has not halted (see Halted).
+func (c *DCPU16) HaltedAt() (pc uint16, ok bool) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.haltPC, c.halted
+}
+
+// TriggerInterrupt queues an interrupt with the given message, to be
+// dispatched at the next instruction boundary at which interrupt queueing is
+// disabled. Unlike most methods, it does not wait for an instruction boundary,
+// so it may be called by a Device's Interrupt method as well as from other
+// goroutines.
+func (c *DCPU16) TriggerInterrupt(message uint16) error {
+	_, err := c.queueInterrupt(message)
+	return err
+}
+
+// SetInterruptOverflowFunc installs f to be called with the number of queued
+// interrupts whenever an INT instruction or TriggerInterrupt finds the
+// interrupt queue full. The interrupt is discarded, and an INT that overflows
+// the queue no longer sets the CPU on fire. A nil f restores the default
+// behavior. f may be called with the CPU locked, so it must not call any
+// methods on the CPU other than TriggerInterrupt.
+func (c *DCPU16) SetInterruptOverflowFunc(f func(queued int)) {
+	c.intMutex.Lock()
+	defer c.intMutex.Unlock()
+
+	c.overflowFunc = f
+}
+
+// SetFaultFunc installs f to be called whenever a fault is detected. A nil f
+// disables fault reporting. f is called with the CPU locked, in the middle
+// of the faulting instruction, so it must not call any methods on the CPU.
+func (c *DCPU16) SetFaultFunc(f func(*Fault)) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.faultFunc = f
+}
+
+// SetDebugInfo installs a line table mapping instruction addresses to the
+// source lines they were assembled from. Faults in instructions found in the
+// table include their source line. A nil table removes the debug info.
+func (c *DCPU16) SetDebugInfo(lines map[uint16]SourceLine) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.debugInfo = lines
+}
+
+// SetTrapPCWrap controls whether a fault is reported when PC wraps around
+// from 0xffff to 0x0000 while fetching an instruction. The specification
+// allows PC to wrap, but it is usually a sign of a runaway program. It is
+// off by default.
+func (c *DCPU16) SetTrapPCWrap(on bool) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.trapPCWrap = on
+}
+
+// SetTrapDivByZero controls whether DIV, DVI, MOD and MDI with a zero divisor
+// report a fault, leaving b and EX unchanged. By default they follow the
+// specification and set the result (and EX) to zero.
+func (c *DCPU16) SetTrapDivByZero(on bool) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.trapDivZero = on
+}
+
+// TotalCycles returns the number of cycles executed since the CPU was created
+// or the cycle counters were last reset. Unlike the TICK register it does not
+// roll over.
+func (c *DCPU16) TotalCycles() uint64 {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.cycles
+}
+
+// ResetCycleCounters zeroes the tick register and the cumulative cycle count
+// without touching any other register or memory. This allows the cost of a
+// specific routine to be measured. The simulated clock used for throttling
+// and TimingSkew is restarted.
+func (c *DCPU16) ResetCycleCounters() {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.tick = 0
+	c.cycles = 0
+	c.resetClock()
+}
+
+// resetClock restarts the simulated clock from the current wall-clock time.
+// The CPU must be locked.
+func (c *DCPU16) resetClock() {
+	c.epoch = time.Time{}
+	c.simulated = 0
+	c.skew = 0
 }
 
 // Step executes a single instruction and returns to the caller.
 func (c *DCPU16) Step() {
+	c.StepInfo()
+}
+
+// StepInfo executes a single instruction and returns a description of it.
+func (c *DCPU16) StepInfo() StepResult {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	wait := c.cycle()
+	r := c.last
+	c.mutex.Unlock()
+
+	time.Sleep(wait)
+	return r
+}
+
+// StepOver executes a single instruction. If the instruction is a JSR, the
+// called subroutine is run until it returns, so that execution stops at the
+// instruction following the JSR.
+func (c *DCPU16) StepOver() error {
+	if c.stepCall() <= 0 {
+		return nil
+	}
+	return c.runToReturn()
+}
+
+// StepOut runs until the current subroutine returns to its caller.
+func (c *DCPU16) StepOut() error {
+	return c.runToReturn()
+}
+
+// runToReturn runs instructions until one more subroutine return than
+// subroutine call has been executed.
+func (c *DCPU16) runToReturn() error {
+	depth := 1
+	for i := 0; i < MAX_STEPOVER; i++ {
+		if depth += c.stepCall(); depth == 0 {
+			return nil
+		}
+	}
+	return ErrNoReturn
+}
+
+// stepCall executes a single instruction and returns 1 if it called a
+// subroutine (JSR), -1 if it returned from one (SET PC, POP) and 0 otherwise.
+// Skipped instructions leave SP unchanged and are not counted.
+func (c *DCPU16) stepCall() int {
+	c.mutex.Lock()
+	w, sp := c.memory[c.pc], c.sp
+	c.mutex.Unlock()
+
 	c.step()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch {
+	case c.sp == sp:
+		return 0
+	case w&OPCODE_MASK == EXT && (w&ARGB_MASK)>>ARGB_SHIFT == JSR:
+		return 1
+	case w == SET|0x1c<<ARGB_SHIFT|0x18<<ARGA_SHIFT:
+		return -1
+	}
+	return 0
 }
 
-// Run executes instructions endlessly.
+// StepN executes up to n instructions, holding the CPU locked throughout,
+// and returns the number of instructions executed, which is less than n if
+// the CPU catches fire or halts (see Halted). Once the CPU is unlocked, StepN
+// sleeps until the simulated clock catches up with the last instruction.
+func (c *DCPU16) StepN(n int) int {
+	// wait for an instruction boundary
+	var wait time.Duration
+	defer func() { time.Sleep(wait) }()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := 0; i < n; i++ {
+		if c.caughtFire {
+			return i
+		}
+		wait = c.cycle()
+		if c.halted {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Run executes instructions until Stop is called, the PC reaches a
+// breakpoint, or the CPU halts (see Halted).
 func (c *DCPU16) Run() {
-	for true {
+	c.RunUntilBreak()
+}
+
+// RunUntilBreak executes instructions until the PC reaches a breakpoint set
+// with SetBreakpoint, returning the address of the breakpoint and true, or
+// until Stop is called, returning false. It also stops after an instruction
+// that triggers a watchpoint set with SetWatchpoint, returning the PC and
+// true; LastWatchpoint reports which watchpoint fired. A breakpoint at the PC when
+// RunUntilBreak is called does not stop execution, so a caller can resume
+// from a breakpoint by calling RunUntilBreak again. If the CPU halts (see
+// Halted), RunUntilBreak returns false.
+func (c *DCPU16) RunUntilBreak() (addr uint16, ok bool) {
+	for first := true; !c.stopRequested(); first = false {
+		if addr, ok := c.atBreakpoint(); ok && !first {
+			return addr, true
+		}
 		c.step()
+		if addr, ok := c.watchpointHit(); ok {
+			return addr, true
+		}
+		if c.Halted() {
+			break
+		}
 	}
+	return 0, false
 }
 
-// step executes a single machine instruction at [pc], updating all registers,
-// memory, and cycle counts.
-func (c *DCPU16) step() {
-	var wait time.Duration
+// SetBreakpoint sets a breakpoint at addr.
+func (c *DCPU16) SetBreakpoint(addr uint16) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.breakpoints == nil {
+		c.breakpoints = make(map[uint16]bool)
+	}
+	c.breakpoints[addr] = true
+}
+
+// ClearBreakpoint removes the breakpoint at addr, if any.
+func (c *DCPU16) ClearBreakpoint(addr uint16) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.breakpoints, addr)
+}
+
+// SetWatchpoint watches addr for reads if onRead is true and writes if
+// onWrite is true. Setting both to false removes the watchpoint.
+func (c *DCPU16) SetWatchpoint(addr uint16, onRead, onWrite bool) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	// hold lock during entire instruction cycle
+	var kind WatchKind
+	if onRead {
+		kind |= WATCH_READ
+	}
+	if onWrite {
+		kind |= WATCH_WRITE
+	}
+	if kind == 0 {
+		delete(c.watchpoints, addr)
+		return
+	}
+	if c.watchpoints == nil {
+		c.watchpoints = make(map[uint16]WatchKind)
+	}
+	c.watchpoints[addr] = kind
+}
+
+// LastWatchpoint returns the address and kind of access of the most recently
+// triggered watchpoint.
+func (c *DCPU16) LastWatchpoint() (addr uint16, kind WatchKind) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lastWatchAddr, c.lastWatchKind
+}
+
+// watchpointHit returns the PC and whether a watchpoint fired during the
+// last instruction.
+func (c *DCPU16) watchpointHit() (uint16, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.pc, c.watchHit
+}
+
+// atBreakpoint returns the PC and whether there is a breakpoint set there.
+func (c *DCPU16) atBreakpoint() (uint16, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.pc, c.breakpoints[c.pc]
+}
+
+// RunContext executes instructions like Run until Stop is called or the CPU
+// halts, returning nil, or until ctx is done, returning ctx.Err().
+func (c *DCPU16) RunContext(ctx context.Context) error {
+	for !c.stopRequested() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.step()
+		if c.Halted() {
+			break
+		}
+	}
+	return nil
+}
+
+// Stop causes Run to return once the current instruction completes. It is
+// safe to call from another goroutine. If Run is not executing, the next
+// call to Run returns immediately.
+func (c *DCPU16) Stop() {
+	// wait for an instruction boundary
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	c.stop = true
+}
+
+// stopRequested reports whether Stop has been called, clearing the request,
+// or the CPU has caught fire.
+func (c *DCPU16) stopRequested() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stop := c.stop
+	c.stop = false
+	return stop || c.caughtFire
+}
+
+// step executes a single machine instruction at [pc], updating all registers,
+// memory, and cycle counts. The CPU is unlocked while waiting for the end of
+// the instruction cycle, so other goroutines are not blocked by throttling.
+func (c *DCPU16) step() {
+	c.mutex.Lock()
+	wait := c.cycle()
+	c.mutex.Unlock()
+
+	time.Sleep(wait)
+}
+
+// cycle executes a single machine instruction and returns the time left
+// before the end of its instruction cycle, which the caller should sleep for
+// once the CPU is unlocked. The CPU must be locked. A CPU that has caught fire
+// executes nothing.
+func (c *DCPU16) cycle() (wait time.Duration) {
+	if c.caughtFire {
+		return 0
+	}
 	start := time.Now()
 	oldtick := c.tick
 
+	c.watchHit = false
+	c.changed = false
+	if c.traceFunc != nil {
+		c.traceFunc(c.pc, c.memory[c.pc])
+	}
+	if c.traceWriter != nil {
+		c.trace()
+	}
+
 	// execute the actual instruction
 	c.execute()
 
-	// process a software interrupt if queuing disabled and and one is queued
-	if !c.intQueueing && len(c.intQueue) > 0 {
-		a := c.intQueue[0]
-		c.intQueue = c.intQueue[1:]
+	// Process a queued interrupt if queuing is disabled. If IA is 0 the
+	// interrupt is discarded; otherwise queuing is enabled until the handler
+	// executes RFI, so at most one interrupt is dispatched at a time.
+	if a, ok := c.nextInterrupt(); ok {
 		if c.ia != 0 {
 			c.intQueueing = true
 			c.pushValue(c.pc)
@@ -220,6 +1076,7 @@ func (c *DCPU16) step() {
 			c.register[A] = a
 		}
 	}
+	c.halted = c.selfJump() || c.stationary()
 
 	if c.tick < oldtick {
 		// tick count rolled over through 0
@@ -227,215 +1084,266 @@ func (c *DCPU16) step() {
 	} else {
 		wait = time.Duration(c.tick - oldtick)
 	}
+	c.cycles += uint64(wait)
+	c.last.Cycles = int(wait)
+
+	// Calculate the amount of time left before the simulated clock catches
+	// up with the end of the instruction. If the wall clock is already past
+	// it, record how far behind the simulated clock we have fallen.
+	if c.unthrottled || c.unlimited {
+		c.epoch = time.Time{}
+		return 0
+	}
+	if c.epoch.IsZero() {
+		c.epoch, c.simulated = start, 0
+	}
+	c.simulated += wait * c.cycleDuration()
+	wait = c.epoch.Add(c.simulated).Sub(time.Now())
+	if wait < 0 {
+		c.skew = -wait
+		return 0
+	}
+	c.skew = 0
+	return wait
+}
 
-	// Calculate the amount of time left before end of instruction cycle, and
-	// sleep if there is time left.
-	end := time.Now()
-	wait = wait*INSTRUCTION_DURATION - end.Sub(start)
-	if wait > 0 {
-		time.Sleep(wait)
+// selfJump reports whether the last instruction was a SET PC of a literal
+// that jumped to its own address, with IA set to 0 so that no interrupt can
+// leave the loop.
+func (c *DCPU16) selfJump() bool {
+	if c.last.Opcode != SET || c.last.Skipped || c.pc != c.last.PC || c.ia != 0 {
+		return false
+	}
+	w := c.memory[c.last.PC]
+	a := (w & ARGA_MASK) >> ARGA_SHIFT
+	if (w&ARGB_MASK)>>ARGB_SHIFT != 0x1c || a < 0x1f {
+		return false
 	}
+	c.haltPC = c.pc
+	return true
+}
+
+// stationary records the state of the registers after the last instruction
+// and reports whether they were in the same state within the last MAX_LOOP
+// instructions. Since memory is unchanged and no device is involved, the
+// instructions in between will repeat forever. The recorded states are
+// discarded whenever the loop could be left by an interrupt (IA is not 0) or
+// by something outside the registers changing.
+func (c *DCPU16) stationary() bool {
+	if c.changed || c.ia != 0 {
+		c.forgetLoop()
+		return false
+	}
+	h := c.loopHash()
+	for _, s := range c.loop[:c.loopLen] {
+		if s.hash == h {
+			c.haltPC = s.pc
+			return true
+		}
+	}
+	c.loop[c.loopNext] = loopState{h, c.pc}
+	c.loopNext = (c.loopNext + 1) % MAX_LOOP
+	if c.loopLen < MAX_LOOP {
+		c.loopLen++
+	}
+	return false
+}
+
+// forgetLoop discards the states recorded for loop detection.
+func (c *DCPU16) forgetLoop() {
+	c.loopLen = 0
+	c.loopNext = 0
+}
+
+// loopHash returns a 64-bit FNV-1a hash of the registers, PC, SP and EX.
+func (c *DCPU16) loopHash() uint64 {
+	h := uint64(14695981039346656037)
+	add := func(w uint16) {
+		h = (h ^ uint64(w>>8)) * 1099511628211
+		h = (h ^ uint64(w&0xff)) * 1099511628211
+	}
+	for _, v := range c.register {
+		add(v)
+	}
+	add(c.pc)
+	add(c.sp)
+	add(c.ex)
+	return h
+}
+
+// SetClockRate sets the clock rate of the CPU to hz cycles per second. A
+// rate of 0 runs the CPU as fast as possible. The rate is independent of
+// SetRealtime: it applies whenever realtime throttling is on.
+func (c *DCPU16) SetClockRate(hz int) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.resetClock()
+	c.unlimited = hz <= 0
+	if c.unlimited {
+		return
+	}
+	c.period = time.Second / time.Duration(hz)
+	if c.period == 0 {
+		c.period = time.Nanosecond
+	}
+}
+
+// SetRealtime turns wall-clock throttling on or off. When off, instructions
+// execute as fast as possible but cycles are counted exactly as before; when
+// on, the CPU runs at the rate last set with SetClockRate, or the default
+// rate if none was set. If that rate is 0 the CPU still runs as fast as
+// possible.
+func (c *DCPU16) SetRealtime(on bool) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.resetClock()
+	c.unthrottled = !on
+}
+
+// cycleDuration returns the wall-clock duration of a single cycle.
+func (c *DCPU16) cycleDuration() time.Duration {
+	if c.period == 0 {
+		return INSTRUCTION_DURATION
+	}
+	return c.period
+}
+
+// TimingSkew returns the amount of wall-clock time by which execution has
+// fallen behind simulated time: the time elapsed since the simulated clock
+// started, less the simulated duration of the cycles executed since then,
+// measured at the end of the last instruction. A growing skew means the host
+// cannot keep up with the configured clock rate. Time spent between calls to
+// Step counts towards the skew; the throttle catches up by running without
+// delay until the skew is 0. The simulated clock is restarted by Reset,
+// ResetCycleCounters and changes to the clock rate.
+func (c *DCPU16) TimingSkew() time.Duration {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.skew
 }
 
 // execute executes single a DCPU16 machine instruction.
 //
 // The bit-level layout of a basic instruction (with LSB on right) has the form:
 // bbbbbbaaaaaaoooo. Where o, a, b are opcode, a-value, b-value respectively.
+//
+// When both operands refer to the same location (e.g., ADD A, A or
+// SET PUSH, POP), a and b are the same host pointer. Every instruction reads
+// both operands before writing the result to b, so an aliased instruction
+// behaves as if a had been copied first: ADD A, A doubles A, SET A, A is a
+// no-op, and XOR A, A clears A.
 func (c *DCPU16) execute() {
-	opcode := c.nextWord()
-	a := c.lea((opcode&ARGA_MASK)>>ARGA_SHIFT, &c.tmpa)
-	b := c.lea((opcode&ARGB_MASK)>>ARGB_SHIFT, &c.tmpb)
+	c.instPC = c.pc
+	word := c.nextWord()
+	opcode := word & OPCODE_MASK
+	a := c.lea((word&ARGA_MASK)>>ARGA_SHIFT, &c.tmpa)
+	aAddr := c.leaAddr
+	c.last = StepResult{PC: c.instPC, Opcode: opcode}
+	if opcode == EXT {
+		// the b field holds the extended opcode; a is the only operand
+		c.last.ExtOpcode = (word & ARGB_MASK) >> ARGB_SHIFT
+		if c.last.ExtOpcode != IAG && aAddr >= 0 {
+			a = c.read(uint16(aAddr), &c.tmpa)
+		}
+		c.last.A = *a
+		c.executeExtended(c.last.ExtOpcode, a)
+		if c.last.ExtOpcode == IAG && aAddr >= 0 {
+			c.changed = c.changed || *a != c.last.A
+			c.written(uint16(aAddr))
+		}
+		return
+	}
+	if aAddr >= 0 {
+		a = c.read(uint16(aAddr), &c.tmpa)
+	}
+	c.last.A = *a
+	b := c.lea((word&ARGB_MASK)>>ARGB_SHIFT, &c.tmpb)
+	bAddr := c.leaAddr
+	if bAddr >= 0 && opcode != SET && opcode != STI && opcode != STD {
+		b = c.read(uint16(bAddr), &c.tmpb)
+	}
+	c.last.B = *b
 
-	if (b == &c.tmpb) && !(opcode >= IFB && opcode <= IFU) {
+	op := basicOps[opcode]
+	if op == nil {
+		c.illegal(fmt.Sprintf("illegal opcode 0x%02x", opcode))
+		return
+	}
+	if bAddr < 0 && b == &c.tmpb && !(opcode >= IFB && opcode <= IFU) {
 		// "If any instruction tries to assign a literal value, the assignment
 		// fails silently. Other than that, the instruction behaves as normal."
 		return
 	}
+	if op(c, a, b) && bAddr >= 0 {
+		// b is a copy if it was read through MapMemoryRead
+		c.memory[bAddr] = *b
+		c.changed = c.changed || *b != c.last.B
+		// only notify watchers once the result has been stored
+		c.written(uint16(bAddr))
+	}
+}
 
-	switch opcode & OPCODE_MASK {
-	case EXT: // extended opcode
-		// at entry, *a = extended opcode, *b = operand
-		// reassign them for consistency with spec
-		opcode = *a
-		*a = *b
-		switch opcode {
-		case JSR: // push current PC onto stack, set PC = A
-			c.pushValue(c.pc)
-			c.pc = *a
-			c.tick += 2
-		case INT: // trigger a software interrupt with message A
-			// Add interrupt to queue, process interrupt queue before next
-			// instruction (if IAQ is zero).
-			if len(c.intQueue) < MAX_INTQUEUE {
-				c.intQueue = append(c.intQueue, *a)
-			} else {
-				panic("Interrupt queue exceeded: processor has caught fire!")
-			}
-			c.tick += 3
-		case IAG: // sets A to IA
-			*a = c.ia
-		case IAS: // sets IA to A
-			c.ia = *a
-		case RFI: // return from interrupt: disable interrupt queuing, pop A, PC
-			c.intQueueing = false
-			c.register[A] = *c.pop()
-			c.pc = *c.pop()
-			c.tick += 2
-		case IAQ: // if A is nonzero, interrupts will be queued, otherwise triggered
-			c.intQueueing = (*a != 0)
-			c.tick++
-		case HWN: // sets A to number of connected hardware devices
-			c.register[A] = 0
-			c.tick++
-		case HWQ: // returns device information about hardware A
-			c.hardwareQuery(*a)
-			c.tick += 3
-		case HWI: // sends an interrupt to hardware A
-			c.handleHardwareInterrupt(*a)
-			c.tick += 3
-		}
-
-	case SET: // sets B to A
-		*b = *a
-	case ADD: // sets B to B+A, sets EX if there's an overflow, 0x0 otherwise
-		v := uint32(*b) + uint32(*a)
-		c.ex = uint16(v >> 16)
-		*b = uint16(v)
-		c.tick++
-	case SUB: // sets B to B-A, sets EX if there's an underflow, 0x0 otherwise
-		v := int32(*b) - int32(*a)
-		c.ex = uint16(v >> 16)
-		*b = uint16(v)
-		c.tick++
-	case MUL, MLI: // sets B to B*A, sets EX to ((B*A)>>16)&0xffff
-		var v int32
-		if opcode == MUL {
-			// unsigned
-			v = int32(uint32(*b) * uint32(*a))
-		} else {
-			// signed
-			v = int32(*b) * int32(*a)
-		}
-		c.ex = uint16(v >> 16)
-		*b = uint16(v)
-		c.tick++
-	case DIV, DVI: // sets B to B/A, sets EX ((B<<16)>>A)&0xffff
-		var v int32
-		if *a == 0 {
-			*b = 0
-			c.ex = 0
-		} else {
-			if opcode == DIV {
-				// unsigned division
-				v = int32(uint32(*b) / uint32(*a))
-			} else {
-				// signed division
-				v = int32(*b) / int32(*a)
-			}
-			c.ex = uint16(v >> 16)
-			*b = uint16(v)
-		}
+// executeExtended executes the extended instruction opcode with the single
+// operand a.
+//
+// The bit-level layout of an extended instruction (with LSB on right) has the
+// form: aaaaaaooooo00000. Where o, a are the extended opcode and a-value
+// respectively. Only the a operand is resolved, so it is the only operand
+// that can consume a next word.
+func (c *DCPU16) executeExtended(opcode uint16, a *uint16) {
+	switch opcode {
+	case JSR: // push current PC onto stack, set PC = A
+		c.pushValue(c.pc)
+		c.pc = *a
 		c.tick += 2
-	case MOD, MDI: // sets B to B%A. if A==0, sets B to 0 instead.
-		if *a == 0 {
-			*b = 0
-		} else {
-			if opcode == MOD {
-				// signed
-				*b %= *a
-			} else {
-				// unsigned
-				*b = uint16(int16(*b) % int16(*a))
-			}
+	case INT: // trigger a software interrupt with message A
+		// Add interrupt to queue, process interrupt queue before next
+		// instruction (if IAQ is zero).
+		c.changed = true
+		if handled, err := c.queueInterrupt(*a); err != nil && !handled {
+			// "If the queue grows longer than 256 interrupts, the DCPU-16
+			// will catch fire."
+			c.caughtFire = true
 		}
+		c.tick += 3
+	case IAG: // sets A to IA
+		*a = c.ia
+	case IAS: // sets IA to A
+		c.ia = *a
+	case RFI: // return from interrupt: disable interrupt queuing, pop A, PC
+		c.intQueueing = false
+		c.register[A] = *c.pop()
+		c.pc = *c.pop()
 		c.tick += 2
-	case AND: // sets B to B&A
-		*b &= *a
-	case BOR: // sets B to B|A
-		*b |= *a
-	case XOR: // sets B to B^A
-		*b ^= *a
-	case SHR: // sets B to B>>A, sets EX to ((B<<16)>>A)&0xffff
-		c.ex = uint16(((uint32(*b) << 16) >> *a))
-		*b >>= *a
-	case ASR: // sets B to B>>A, sets EX to ((B<<16)>>>A)&0xffff (treats b as signed)
-		c.ex = uint16(((int32(*b) << 16) >> *a))
-		t := int16(*b)
-		t >>= *a
-		*b = uint16(t)
-	case SHL: // sets B to B<<A, sets EX to ((B<<A)>>16)&0xffff
-		c.ex = uint16(((uint32(*b) << *a) >> 16))
-		*b <<= *a
-	case IFB: // performs next instruction only if (B&A)!=0
-		if !((*b & *a) != 0) {
-			c.skipConditional()
-		}
+	case IAQ: // if A is nonzero, interrupts will be queued, otherwise triggered
+		c.intQueueing = (*a != 0)
 		c.tick++
-	case IFC: // performs next instruction only if (B&A)==0
-		if !((*b & *a) == 0) {
-			c.skipConditional()
-		}
-		c.tick++
-	case IFE: // performs next instruction only if B==A
-		if !(*b == *a) {
-			c.skipConditional()
-		}
-		c.tick++
-	case IFN: // performs next instruction only if B!=A
-		if !(*b != *a) {
-			c.skipConditional()
-		}
-		c.tick++
-	case IFG: // performs next instruction only if B > A
-		if !(*b > *a) {
-			c.skipConditional()
-		}
-		c.tick++
-	case IFA: // performs next instruction only if B > A (signed)
-		if !(int16(*b) > int16(*a)) {
-			c.skipConditional()
-		}
-		c.tick++
-	case IFL: // perform next instruction only if B < A
-		if !(*b < *a) {
-			c.skipConditional()
-		}
-		c.tick++
-	case IFU: // perform next instruction only if B < A (signed)
-		if !(int16(*b) < int16(*a)) {
-			c.skipConditional()
-		}
-		c.tick++
-	case ADX:
-		v := int32(*b) + int32(*a) + int32(c.ex)
-		if v > math.MaxInt16 {
-			c.ex = 1
-		} else {
-			c.ex = 0
-		}
-		*b = uint16(v)
-		c.tick += 2
-	case SBX:
-		v := int32(*b) - int32(*a) + int32(c.ex)
-		if v < math.MinInt16 {
-			c.ex = 0xffff
-		} else {
-			c.ex = 0
-		}
-		*b = uint16(v)
-		c.tick += 2
-	case STI, STD: // sets B to A, then increases / decreases I and J by 1
-		*b = *a
-		if opcode == STI {
-			c.register[I]++
-			c.register[J]++
-		} else {
-			c.register[I]--
-			c.register[J]--
-		}
+	case HWN: // sets A to number of connected hardware devices
+		c.register[A] = uint16(len(c.hardware))
 		c.tick++
+	case HWQ: // returns device information about hardware A
+		c.hardwareQuery(*a)
+		c.tick += 3
+	case HWI: // sends an interrupt to hardware A
+		c.changed = true
+		c.handleHardwareInterrupt(*a)
+		c.tick += 3
+	default:
+		c.illegal(fmt.Sprintf("illegal extended opcode 0x%02x", opcode))
 	}
-	return
+}
+
+// illegal records that the current instruction has an undefined opcode,
+// which has no effect, and reports a fault with the given reason.
+func (c *DCPU16) illegal(reason string) {
+	c.last.Illegal = true
+	c.fault(reason)
 }
 
 // lea (Load Effective Address) returns the address of the value given by the
@@ -444,23 +1352,29 @@ func (c *DCPU16) execute() {
 //
 // Note this function returns a host pointer to guest memory, register, or
 // constant buffer.
+//
+// Computed addresses ([next word + register] and PICK n) wrap around the end
+// of memory: they are 16-bit sums, so [0xffff+A] with A == 2 refers to
+// address 0x0001. Since RAMSIZE covers the whole 16-bit address space, every
+// computed address is a valid index into memory.
 func (c *DCPU16) lea(addr uint16, tmp *uint16) *uint16 {
+	c.leaAddr = -1
 	switch {
 	case addr <= 0x07: // register
 		return &c.register[addr]
 	case addr <= 0x0f: // [register]
-		return &c.memory[c.register[addr-0x08]]
+		return c.mem(c.register[addr-0x08])
 	case addr <= 0x17: // [next word + register]
-		return &c.memory[c.nextWord()+c.register[addr-0x10]]
+		return c.mem(c.nextWord() + c.register[addr-0x10])
 	case addr == 0x18: // POP (a) or PUSH (b)
 		if tmp == &c.tmpa {
 			return c.pop()
 		}
 		return c.push()
 	case addr == 0x19: // PEEK
-		return &c.memory[c.sp]
+		return c.mem(c.sp)
 	case addr == 0x1a: // PICK n: [SP + next word]
-		return &c.memory[c.sp+c.nextWord()]
+		return c.mem(c.sp + c.nextWord())
 	case addr == 0x1b: // SP
 		return &c.sp
 	case addr == 0x1c: // PC
@@ -468,26 +1382,150 @@ func (c *DCPU16) lea(addr uint16, tmp *uint16) *uint16 {
 	case addr == 0x1d: // EX
 		return &c.ex
 	case addr == 0x1e: // [next word]
-		return &c.memory[c.nextWord()]
+		return c.mem(c.nextWord())
 	case addr == 0x1f: // next word (literal)
 		*tmp = c.nextWord()
 		return tmp
 	case addr <= 0x3f: // literal value 0xffff-0x1e (-1..30)
-		*tmp = addr - 0x20 - 1
+		*tmp = ShortLiteral(addr)
 		return tmp
 	}
 	// will never be reached
 	return nil
 }
 
-// skipConditional advances the PC to next word of memory. If the word being skipped
-// is an IFx instruction, then skip two words (e.g., skip both branches of the
-// IFx instruction), allowing for easy conditional chaining.
+// mem returns a host pointer to guest memory at addr, recording addr as the
+// address of the operand being resolved by lea.
+func (c *DCPU16) mem(addr uint16) *uint16 {
+	c.leaAddr = int(addr)
+	return &c.memory[addr]
+}
+
+// read returns the operand at memory address addr, which an instruction is
+// about to read. If addr is mapped with MapMemoryRead the value is supplied
+// by the mapping function and stored in tmp, and tmp is returned; otherwise
+// the operand is a host pointer to guest memory.
+func (c *DCPU16) read(addr uint16, tmp *uint16) *uint16 {
+	c.watch(addr, WATCH_READ)
+	for _, m := range c.mappings {
+		if m.onRead != nil && addr >= m.lo && addr <= m.hi {
+			*tmp = m.onRead(addr)
+			c.changed = true
+			return tmp
+		}
+	}
+	return &c.memory[addr]
+}
+
+// written notifies the functions registered with MapMemory and MapDevice of
+// a write to addr.
+func (c *DCPU16) written(addr uint16) {
+	c.watch(addr, WATCH_WRITE)
+	for _, m := range c.mappings {
+		if m.onWrite != nil && addr >= m.lo && addr <= m.hi {
+			m.onWrite(addr, c.memory[addr])
+		}
+	}
+}
+
+// watch records an access of kind to addr if it is watched.
+func (c *DCPU16) watch(addr uint16, kind WatchKind) {
+	if c.watchpoints[addr]&kind != 0 {
+		c.watchHit = true
+		c.lastWatchAddr, c.lastWatchKind = addr, kind
+	}
+}
+
+// queueInterrupt adds an interrupt with message msg to the interrupt queue.
+// If the queue is full it returns ErrInterruptQueueFull, and handled reports
+// whether the overflow function was called.
+func (c *DCPU16) queueInterrupt(msg uint16) (handled bool, err error) {
+	c.intMutex.Lock()
+	if n := len(c.intQueue); n >= MAX_INTQUEUE {
+		f := c.overflowFunc
+		c.intMutex.Unlock()
+		if f != nil {
+			f(n)
+		}
+		return f != nil, ErrInterruptQueueFull
+	}
+	c.intQueue = append(c.intQueue, msg)
+	c.intMutex.Unlock()
+	return false, nil
+}
+
+// nextInterrupt removes and returns the next queued interrupt message, if
+// interrupt queueing is disabled and one is queued.
+func (c *DCPU16) nextInterrupt() (uint16, bool) {
+	c.intMutex.Lock()
+	defer c.intMutex.Unlock()
+
+	if c.intQueueing || len(c.intQueue) == 0 {
+		return 0, false
+	}
+	msg := c.intQueue[0]
+	c.intQueue = c.intQueue[1:]
+	return msg, true
+}
+
+// skipConditional advances the PC past the next instruction, including its
+// operand words, at a cost of one cycle. If the skipped instruction is itself
+// an IFx instruction, the instruction following it is skipped too (at a cost
+// of another cycle), allowing for easy conditional chaining.
 func (c *DCPU16) skipConditional() {
-	op := c.nextWord()
-	if op >= IFB && op <= IFU {
-		c.nextWord()
+	c.last.Skipped = true
+	for {
+		word := c.memory[c.pc]
+		c.pc += instructionLength(word)
+		c.tick++
+		if op := word & OPCODE_MASK; op < IFB || op > IFU {
+			return
+		}
+	}
+}
+
+// ShortLiteral returns the value of the short literal addressing mode mode,
+// 0x20-0x3f, which encodes the values 0xffff (-1) to 30.
+func ShortLiteral(mode uint16) uint16 {
+	return mode - 0x20 - 1
+}
+
+// ShortLiteralMode returns the short literal addressing mode for v, and false
+// if v is outside the range -1 (0xffff) to 30 and needs a next word literal.
+func ShortLiteralMode(v uint16) (mode uint16, ok bool) {
+	if v > 30 && v != 0xffff {
+		return 0, false
+	}
+	return v + 0x20 + 1, true
+}
+
+// InstructionLength returns the number of words (1, 2 or 3), including
+// operand words, occupied by the instruction at m[pc], or 0 if pc is outside
+// m. The operand words themselves need not be present in m.
+func InstructionLength(m []uint16, pc uint16) int {
+	if int(pc) >= len(m) {
+		return 0
+	}
+	return int(instructionLength(m[pc]))
+}
+
+// instructionLength returns the number of words, including operand words,
+// of the instruction whose first word is word.
+func instructionLength(word uint16) uint16 {
+	n := 1 + operandLength((word&ARGA_MASK)>>ARGA_SHIFT)
+	if word&OPCODE_MASK != EXT {
+		n += operandLength((word & ARGB_MASK) >> ARGB_SHIFT)
 	}
+	return n
+}
+
+// operandLength returns the number of next words used by addressing mode
+// mode.
+func operandLength(mode uint16) uint16 {
+	if (mode >= 0x10 && mode <= 0x17) || mode == 0x1a || mode == 0x1e || mode == 0x1f {
+		return 1
+	}
+	return 0
 }
 
 // nextWord returns the value of the memory at [pc] and increments the pc.
@@ -495,26 +1533,44 @@ func (c *DCPU16) nextWord() (v uint16) {
 	v = c.memory[c.pc]
 	c.pc++
 	c.tick++
+	if c.pc == 0 && c.trapPCWrap {
+		c.fault("PC wrapped around the end of memory")
+	}
 	return
 }
 
+// fault reports a fault in the current instruction to the fault function,
+// if one is installed.
+func (c *DCPU16) fault(reason string) {
+	if c.faultFunc != nil {
+		c.faultFunc(&Fault{
+			Name:   c.name,
+			PC:     c.instPC,
+			Reason: reason,
+			Source: c.debugInfo[c.instPC],
+		})
+	}
+}
+
 // push returns the value &[--sp]
 // Note: returns a host pointer to the guest memory.
 func (c *DCPU16) push() (v *uint16) {
 	c.sp--
-	return &c.memory[c.sp]
+	return c.mem(c.sp)
 }
 
 // pushValue pushes the word val onto the stack.
 func (c *DCPU16) pushValue(val uint16) {
 	c.sp--
+	c.changed = c.changed || c.memory[c.sp] != val
 	c.memory[c.sp] = val
+	c.written(c.sp)
 }
 
 // pop returns the value &[sp++]
 // Note: returns a host pointer to the guest memory.
 func (c *DCPU16) pop() (v *uint16) {
-	v = &c.memory[c.sp]
+	v = c.mem(c.sp)
 	c.sp++
 	return
 }
@@ -542,10 +1598,23 @@ func (c *DCPU16) pop() (v *uint16) {
 // the hardware version. X+(Y<<16) is a 32-bit word identifying the
 // manufacturer
 func (c *DCPU16) hardwareQuery(hwindex uint16) {
-	return
+	var id, manufacturer uint32
+	var version uint16
+	if int(hwindex) < len(c.hardware) {
+		d := c.hardware[hwindex]
+		id, version, manufacturer = d.ID(), d.Version(), d.Manufacturer()
+	}
+	c.register[A] = uint16(id)
+	c.register[B] = uint16(id >> 16)
+	c.register[C] = version
+	c.register[X] = uint16(manufacturer)
+	c.register[Y] = uint16(manufacturer >> 16)
 }
 
-// handleHardwareInterrupt handles sending an interrupt to a hardware device
+// handleHardwareInterrupt handles sending an interrupt to a hardware device,
+// adding the cycles the device reports to the tick count.
 func (c *DCPU16) handleHardwareInterrupt(hwint uint16) {
-	return
+	if int(hwint) < len(c.hardware) {
+		c.tick += c.hardware[hwint].Interrupt(c)
+	}
 }
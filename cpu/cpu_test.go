@@ -1,8 +1,12 @@
 package cpu
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 )
 
 const (
@@ -151,6 +155,29 @@ func TestSetAllShortLiterals(t *testing.T) {
 	}
 }
 
+func TestShortLiteralValues(t *testing.T) {
+	tests := []struct {
+		code  uint16
+		value uint16
+	}{
+		{0x20, 0xffff}, {0x21, 0}, {0x22, 1}, {0x23, 2},
+		{0x24, 3}, {0x25, 4}, {0x26, 5}, {0x27, 6},
+		{0x28, 7}, {0x29, 8}, {0x2a, 9}, {0x2b, 10},
+		{0x2c, 11}, {0x2d, 12}, {0x2e, 13}, {0x2f, 14},
+		{0x30, 15}, {0x31, 16}, {0x32, 17}, {0x33, 18},
+		{0x34, 19}, {0x35, 20}, {0x36, 21}, {0x37, 22},
+		{0x38, 23}, {0x39, 24}, {0x3a, 25}, {0x3b, 26},
+		{0x3c, 27}, {0x3d, 28}, {0x3e, 29}, {0x3f, 30},
+	}
+
+	c := new(DCPU16)
+	for _, test := range tests {
+		if v := *c.lea(test.code, &c.tmpa); v != test.value {
+			t.Errorf("0x%02x: expected %d, got %d\n", test.code, test.value, v)
+		}
+	}
+}
+
 func TestSetAssignLiteral(t *testing.T) {
 	c := new(DCPU16)
 	c.memory[0] = makeOpcode(SET, 0x1f, 0x3f) // SET 0x0030, 30
@@ -305,10 +332,9 @@ func TestDIV(t *testing.T) {
 		c.register[B] = 0x7f3f
 		c.register[A] = uint16(i)
 		e := c.Registers()
-		ov := uint32(c.register[A]) / uint32(c.register[B])
 		e[B] = c.register[B]
-		e[A] = uint16(ov)
-		e[EX] = uint16(ov >> 16)
+		e[A] = c.register[A] / c.register[B]
+		e[EX] = uint16((uint32(c.register[A]) << 16) / uint32(c.register[B]))
 		e[PC] = 1
 		e[TICK] = c.tick + 3
 		c.step()
@@ -316,6 +342,62 @@ func TestDIV(t *testing.T) {
 	}
 }
 
+func TestDIVRemainder(t *testing.T) {
+	tests := []struct {
+		op, b, a, quot, ex uint16
+	}{
+		{DIV, 7, 2, 3, 0x8000},
+		{DIV, 1, 3, 0, 0x5555},
+		{DIV, 0xffff, 0x10, 0x0fff, 0xf000},
+		{DVI, 0xfff9, 2, 0xfffd, 0x8000}, // -7 / 2
+		{DVI, 7, 0xfffe, 0xfffd, 0x8000}, // 7 / -2
+		{DVI, 0xfffc, 0xfffe, 2, 0},      // -4 / -2
+	}
+
+	for _, test := range tests {
+		c := new(DCPU16)
+		c.memory[0] = makeOpcode(int(test.op), A, B) // DIV/DVI A, B
+		c.register[A] = test.b
+		c.register[B] = test.a
+		e := c.Registers()
+		e[A] = test.quot
+		e[EX] = test.ex
+		e[PC] = 1
+		e[TICK] = 3
+		c.step()
+		checkRegisters(e, c, t, fmt.Sprintf("op 0x%02x: 0x%04x / 0x%04x", test.op, test.b, test.a))
+	}
+}
+
+func TestADXSBX(t *testing.T) {
+	tests := []struct {
+		op, b, a, ex, result, newEx uint16
+	}{
+		{ADX, 0xffff, 1, 0, 0, 0x0001},      // carry
+		{ADX, 0xfffe, 1, 1, 0, 0x0001},      // carry from EX
+		{ADX, 0x7fff, 1, 0, 0x8000, 0},      // no unsigned overflow
+		{SBX, 0, 1, 0, 0xffff, 0xffff},      // borrow
+		{SBX, 1, 1, 0xffff, 0xffff, 0xffff}, // borrow from EX
+		{SBX, 0xffff, 0, 1, 0, 0x0001},      // overflow
+		{SBX, 0x8000, 1, 0, 0x7fff, 0},      // no unsigned underflow
+	}
+
+	for _, test := range tests {
+		c := new(DCPU16)
+		c.memory[0] = makeOpcode(int(test.op), A, B) // ADX/SBX A, B
+		c.register[A] = test.b
+		c.register[B] = test.a
+		c.ex = test.ex
+		e := c.Registers()
+		e[A] = test.result
+		e[EX] = test.newEx
+		e[PC] = 1
+		e[TICK] = 3
+		c.step()
+		checkRegisters(e, c, t, fmt.Sprintf("op 0x%02x: 0x%04x, 0x%04x (EX=0x%04x)", test.op, test.b, test.a, test.ex))
+	}
+}
+
 func TestMOD(t *testing.T) {
 	c := new(DCPU16)
 	c.memory[0] = makeOpcode(MOD, 0, 1) // MOD A,B
@@ -352,6 +434,83 @@ func TestMOD(t *testing.T) {
 	checkRegisters(e, c, t, "MOD A,B (A=0, B=0x17)")
 }
 
+func TestMDI(t *testing.T) {
+	tests := []struct {
+		op, b, a, result uint16
+	}{
+		{MOD, 0xfff9, 16, 0x0009}, // 65529 % 16
+		{MDI, 0xfff9, 16, 0xfff9}, // -7 % 16 == -7
+		{MDI, 7, 0xfff0, 7},       // 7 % -16 == 7
+		{MDI, 0xffff, 0xffff, 0},  // -1 % -1 == 0
+		{MDI, 0xffef, 5, 0xfffe},  // -17 % 5 == -2
+	}
+
+	for _, test := range tests {
+		c := new(DCPU16)
+		c.memory[0] = makeOpcode(int(test.op), A, B) // MOD/MDI A, B
+		c.register[A] = test.b
+		c.register[B] = test.a
+		e := c.Registers()
+		e[A] = test.result
+		e[PC] = 1
+		e[TICK] = 3
+		c.step()
+		checkRegisters(e, c, t, fmt.Sprintf("op 0x%02x: 0x%04x %% 0x%04x", test.op, test.b, test.a))
+	}
+}
+
+func TestMLI(t *testing.T) {
+	tests := []struct {
+		b, a, result, ex uint16
+	}{
+		{0xffff, 0x0002, 0xfffe, 0xffff}, // -1 * 2 == -2
+		{0xffff, 0xffff, 0x0001, 0x0000}, // -1 * -1 == 1
+		{0x8000, 0xffff, 0x8000, 0x0000}, // -32768 * -1 == 32768
+		{0x8000, 0x8000, 0x0000, 0x4000}, // -32768 * -32768 == 0x40000000
+		{0x8000, 0x0002, 0x0000, 0xffff}, // -32768 * 2 == -65536
+	}
+
+	for _, test := range tests {
+		c := new(DCPU16)
+		c.memory[0] = makeOpcode(MLI, A, B) // MLI A, B
+		c.register[A] = test.b
+		c.register[B] = test.a
+		e := c.Registers()
+		e[A] = test.result
+		e[EX] = test.ex
+		e[PC] = 1
+		e[TICK] = 2
+		c.step()
+		checkRegisters(e, c, t, fmt.Sprintf("MLI 0x%04x, 0x%04x", test.b, test.a))
+	}
+}
+
+func TestDVI(t *testing.T) {
+	tests := []struct {
+		b, a, result, ex uint16
+	}{
+		{0xfff9, 0x0002, 0xfffd, 0x8000}, // -7 / 2 == -3
+		{0x0007, 0xfffe, 0xfffd, 0x8000}, // 7 / -2 == -3
+		{0xfff9, 0xfffe, 0x0003, 0x8000}, // -7 / -2 == 3
+		{0x8000, 0xffff, 0x8000, 0x0000}, // -32768 / -1 overflows
+		{0xffff, 0x0000, 0x0000, 0x0000}, // division by zero
+	}
+
+	for _, test := range tests {
+		c := new(DCPU16)
+		c.memory[0] = makeOpcode(DVI, A, B) // DVI A, B
+		c.register[A] = test.b
+		c.register[B] = test.a
+		e := c.Registers()
+		e[A] = test.result
+		e[EX] = test.ex
+		e[PC] = 1
+		e[TICK] = 3
+		c.step()
+		checkRegisters(e, c, t, fmt.Sprintf("DVI 0x%04x, 0x%04x", test.b, test.a))
+	}
+}
+
 func TestSHL(t *testing.T) {
 	c := new(DCPU16)
 	c.memory[0] = makeOpcode(SHL, 0, 1) // SHR A,B
@@ -434,6 +593,41 @@ func TestSHR(t *testing.T) {
 	checkRegisters(e, c, t, "SHR A,B (A=0xFFFF,B=32)")
 }
 
+func TestLargeShifts(t *testing.T) {
+	tests := []struct {
+		op       int
+		name     string
+		a, b     uint16 // register A is shifted by register B
+		result   uint16
+		overflow uint16
+	}{
+		{SHR, "SHR", 0x8001, 16, 0x0000, 0x8001},
+		{SHR, "SHR", 0x8001, 17, 0x0000, 0x4000},
+		{SHR, "SHR", 0x8001, 32, 0x0000, 0x0000},
+		{SHL, "SHL", 0x8001, 16, 0x0000, 0x8001},
+		{SHL, "SHL", 0x8001, 17, 0x0000, 0x0002},
+		{SHL, "SHL", 0x8001, 32, 0x0000, 0x0000},
+		{ASR, "ASR", 0x8001, 16, 0xffff, 0x8001},
+		{ASR, "ASR", 0x8001, 17, 0xffff, 0xc000},
+		{ASR, "ASR", 0x8001, 32, 0xffff, 0xffff},
+		{ASR, "ASR", 0x4001, 17, 0x0000, 0x2000},
+		{ASR, "ASR", 0x4001, 32, 0x0000, 0x0000},
+	}
+	for _, tt := range tests {
+		c := new(DCPU16)
+		c.memory[0] = makeOpcode(tt.op, A, B) // op A,B
+		c.register[A] = tt.a
+		c.register[B] = tt.b
+		e := c.Registers()
+		e[A] = tt.result
+		e[EX] = tt.overflow
+		e[PC] = 1
+		e[TICK] = 1
+		c.step()
+		checkRegisters(e, c, t, fmt.Sprintf("%s A,B (A=0x%04x, B=%d)", tt.name, tt.a, tt.b))
+	}
+}
+
 func TestAND(t *testing.T) {
 	c := new(DCPU16)
 	c.memory[0] = makeOpcode(AND, 0, 1) // AND A,B
@@ -618,6 +812,43 @@ func TestIFG(t *testing.T) {
 	checkRegisters(e, c, t, "IFG A<B")
 }
 
+func TestSignedConditionals(t *testing.T) {
+	tests := []struct {
+		op       int
+		name     string
+		b, a     uint16
+		executes bool
+	}{
+		{IFG, "IFG", 0x7fff, 0x8000, false}, // unsigned 32767 > 32768
+		{IFG, "IFG", 0x8000, 0x7fff, true},
+		{IFA, "IFA", 0x7fff, 0x8000, true}, // signed 32767 > -32768
+		{IFA, "IFA", 0x8000, 0x7fff, false},
+		{IFL, "IFL", 0x7fff, 0x8000, true}, // unsigned 32767 < 32768
+		{IFL, "IFL", 0x8000, 0x7fff, false},
+		{IFU, "IFU", 0x7fff, 0x8000, false}, // signed 32767 < -32768
+		{IFU, "IFU", 0x8000, 0x7fff, true},
+		{IFA, "IFA", 0x8000, 0x8000, false},
+		{IFU, "IFU", 0x8000, 0x8000, false},
+	}
+
+	for _, test := range tests {
+		c := new(DCPU16)
+		c.memory[0] = makeOpcode(test.op, A, B) // op A, B
+		c.register[A] = test.b
+		c.register[B] = test.a
+		e := c.Registers()
+		if test.executes {
+			e[PC] = 1
+			e[TICK] = 2
+		} else {
+			e[PC] = 2
+			e[TICK] = 3
+		}
+		c.step()
+		checkRegisters(e, c, t, fmt.Sprintf("%s 0x%04x, 0x%04x", test.name, test.b, test.a))
+	}
+}
+
 func TestIFB(t *testing.T) {
 	c := new(DCPU16)
 
@@ -665,6 +896,1500 @@ func TestTickOverflow(t *testing.T) {
 	checkRegisters(e, c, t, "IFB A&B == 0")
 }
 
+func TestAliasedOperands(t *testing.T) {
+	c := new(DCPU16)
+
+	c.memory[0] = makeOpcode(ADD, 0, 0) // ADD A, A
+	c.register[A] = 0x1234
+	e := c.Registers()
+	e[A] = 0x2468
+	e[PC] = 1
+	e[TICK] = 2
+	c.step()
+	checkRegisters(e, c, t, "ADD A,A")
+
+	c.pc = 0
+	c.memory[0] = makeOpcode(SET, 0, 0) // SET A, A
+	e[TICK] = c.tick + 1
+	c.step()
+	checkRegisters(e, c, t, "SET A,A")
+
+	c.pc = 0
+	c.memory[0] = makeOpcode(XOR, 0, 0) // XOR A, A
+	e[A] = 0
+	e[TICK] = c.tick + 1
+	c.step()
+	checkRegisters(e, c, t, "XOR A,A")
+
+	c.pc = 0
+	c.memory[0] = makeOpcode(SHL, 0, 0) // SHL A, A
+	c.register[A] = 0x0004
+	e[A] = 0x0040
+	e[EX] = 0
+	e[TICK] = c.tick + 1
+	c.step()
+	checkRegisters(e, c, t, "SHL A,A")
+
+	c.pc = 0
+	c.memory[0] = makeOpcode(SHR, 0, 0) // SHR A, A
+	c.register[A] = 0x0004
+	e[A] = 0
+	e[EX] = 0x4000
+	e[TICK] = c.tick + 1
+	c.step()
+	checkRegisters(e, c, t, "SHR A,A")
+
+	c.pc = 0
+	c.memory[0] = makeOpcode(STI, I, I) // STI I, I
+	c.register[I] = 0x0010
+	c.register[J] = 0x0020
+	e[I] = 0x0011
+	e[J] = 0x0021
+	e[TICK] = c.tick + 2
+	c.step()
+	checkRegisters(e, c, t, "STI I,I")
+
+	c.pc = 0
+	c.memory[0] = makeOpcode(STD, J, J) // STD J, J
+	e[I] = 0x0010
+	e[J] = 0x0020
+	e[TICK] = c.tick + 2
+	c.step()
+	checkRegisters(e, c, t, "STD J,J")
+}
+
+func TestSTISTDWraparound(t *testing.T) {
+	c := new(DCPU16)
+	c.Write(0x100, []uint16{
+		makeOpcode(STI, A, 0x10+J), 0x0010, // STI A, [0x10+J]
+		makeOpcode(STD, 0x08+I, X), // STD [I], X
+	})
+	c.pc = 0x100
+	c.register[I] = 0xffff
+	c.register[J] = 0xffff
+	c.register[X] = 0x5678
+	c.memory[0x000f] = 0x1234
+	e := c.Registers()
+	e[A] = 0x1234
+	e[I] = 0
+	e[J] = 0
+	e[PC] = 0x102
+	e[TICK] = 3
+	c.step()
+	checkRegisters(e, c, t, "STI A, [0x10+J] (I=J=0xffff)")
+
+	e[I] = 0xffff
+	e[J] = 0xffff
+	e[PC] = 0x103
+	e[TICK] = 5
+	c.step()
+	checkRegisters(e, c, t, "STD [I], X (I=J=0)")
+	if c.memory[0] != 0x5678 {
+		t.Errorf("Expected STD to write 0x5678 to 0x0000, got 0x%04x\n", c.memory[0])
+	}
+}
+
+func TestTimingSkew(t *testing.T) {
+	c := new(DCPU16)
+	c.memory[0] = makeOpcode(SET, 0x1c, 0x21) // SET PC, 0
+
+	// one cycle per nanosecond can't be sustained by the host
+	c.period = time.Nanosecond
+	c.step()
+	s1 := c.TimingSkew()
+	for i := 0; i < 100; i++ {
+		c.step()
+	}
+	s2 := c.TimingSkew()
+	if s1 <= 0 || s2 <= s1 {
+		t.Errorf("Expected skew to grow, got %v then %v\n", s1, s2)
+	}
+
+	c.ResetCycleCounters()
+	if s := c.TimingSkew(); s != 0 {
+		t.Errorf("Expected ResetCycleCounters to clear the skew, got %v\n", s)
+	}
+
+	// a host that keeps up, sleeping off each cycle, has next to no skew;
+	// allow for scheduling delays on a loaded machine
+	c.SetClockRate(1000)
+	for i := 0; i < 5; i++ {
+		c.Step()
+	}
+	if s := c.TimingSkew(); s > 5*time.Millisecond {
+		t.Errorf("Expected little skew at 1kHz, got %v\n", s)
+	}
+}
+
+func TestResetCycleCounters(t *testing.T) {
+	c := new(DCPU16)
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x1f), 0x1234, // SET A, 0x1234 (2 cycles)
+		makeOpcode(ADD, A, 0x22), // ADD A, 1 (2 cycles)
+		makeOpcode(SET, B, A),    // SET B, A (1 cycle)
+		makeOpcode(DIV, B, 0x23), // DIV B, 2 (3 cycles)
+	})
+	c.step()
+	c.step()
+	if c.TotalCycles() != 4 {
+		t.Errorf("Expected 4 cycles, got %d\n", c.TotalCycles())
+	}
+
+	c.ResetCycleCounters()
+	e := c.Registers()
+	e[TICK] = 0
+	checkRegisters(e, c, t, "ResetCycleCounters")
+	if c.TotalCycles() != 0 {
+		t.Errorf("Expected cycles to be reset, got %d\n", c.TotalCycles())
+	}
+
+	c.step()
+	c.step()
+	if c.TotalCycles() != 4 {
+		t.Errorf("Expected routine to take 4 cycles, got %d\n", c.TotalCycles())
+	}
+	if r := c.Registers(); r[A] != 0x1235 || r[B] != 0x091a {
+		t.Errorf("Expected A=0x1235, B=0x091a, got: %v\n", r)
+	}
+}
+
+func TestUsedRegions(t *testing.T) {
+	c := new(DCPU16)
+	c.Write(0x0010, []uint16{1, 2, 3})
+	c.Write(0x0020, []uint16{4, 0, 5})
+	c.Write(0xfffe, []uint16{6, 7})
+
+	r := c.UsedRegions(0)
+	e := [][2]uint16{{0x10, 0x12}, {0x20, 0x20}, {0x22, 0x22}, {0xfffe, 0xffff}}
+	if fmt.Sprint(r) != fmt.Sprint(e) {
+		t.Errorf("Expected regions %v, got %v\n", e, r)
+	}
+
+	// a one word gap is coalesced, the 13 word gap is not
+	r = c.UsedRegions(2)
+	e = [][2]uint16{{0x10, 0x12}, {0x20, 0x22}, {0xfffe, 0xffff}}
+	if fmt.Sprint(r) != fmt.Sprint(e) {
+		t.Errorf("Expected regions %v, got %v\n", e, r)
+	}
+
+	r = c.UsedRegions(14)
+	e = [][2]uint16{{0x10, 0x22}, {0xfffe, 0xffff}}
+	if fmt.Sprint(r) != fmt.Sprint(e) {
+		t.Errorf("Expected regions %v, got %v\n", e, r)
+	}
+}
+
+func TestTrapPCWrap(t *testing.T) {
+	var faults []*Fault
+	c := new(DCPU16)
+	c.SetFaultFunc(func(f *Fault) { faults = append(faults, f) })
+	c.memory[0xffff] = makeOpcode(SET, A, 0x22) // SET A, 1
+
+	c.pc = 0xffff
+	c.step()
+	if len(faults) != 0 {
+		t.Errorf("Expected no faults by default, got: %v\n", faults)
+	}
+
+	c.SetTrapPCWrap(true)
+	c.pc = 0xffff
+	c.step()
+	if len(faults) != 1 || faults[0].PC != 0xffff {
+		t.Errorf("Expected one fault at 0xffff, got: %v\n", faults)
+	}
+	if r := c.Registers(); r[A] != 1 || r[PC] != 0 {
+		t.Errorf("Expected the instruction to complete, got: %v\n", r)
+	}
+}
+
+func TestInterruptReentrancy(t *testing.T) {
+	c := new(DCPU16)
+	c.Write(0, []uint16{
+		makeOpcode(EXT, IAS, 0x31), // IAS 0x10
+		makeOpcode(EXT, INT, 0x22), // INT 1
+		makeOpcode(SET, X, 0x21),   // SET X, 0
+	})
+	c.Write(0x10, []uint16{
+		makeOpcode(EXT, INT, 0x23), // INT 2
+		makeOpcode(ADD, Y, A),      // ADD Y, A
+		makeOpcode(EXT, RFI, 0x21), // RFI 0
+	})
+
+	c.step() // IAS 0x10
+	c.step() // INT 1, dispatched immediately
+	e := c.Registers()
+	if e[PC] != 0x10 || e[A] != 1 || e[IQ] != 1 {
+		t.Fatalf("Expected handler entry with A=1 and queueing on, got: %v\n", e)
+	}
+
+	c.step() // INT 2, must queue rather than re-enter the handler
+	r := c.Registers()
+	if r[PC] != 0x11 || r[A] != 1 || r[IQ] != 1 {
+		t.Errorf("Expected INT 2 to queue inside the handler, got: %v\n", r)
+	}
+	c.step() // ADD Y, A
+	c.step() // RFI, which releases the queued interrupt
+	r = c.Registers()
+	if r[PC] != 0x10 || r[A] != 2 || r[Y] != 1 || r[IQ] != 1 {
+		t.Errorf("Expected queued interrupt to run after RFI, got: %v\n", r)
+	}
+	if r[SP] != 0xfffe || c.memory[0xffff] != 2 || c.memory[0xfffe] != 0 {
+		t.Errorf("Expected PC=2, A=0 on the stack, got SP=0x%04x %v\n", r[SP], c.memory[0xfffe:])
+	}
+
+	c.step() // INT 2 again, from the second invocation
+	c.step() // ADD Y, A
+	c.step() // RFI, dispatching the third interrupt
+	c.step() // INT 2
+	c.step() // ADD Y, A
+	r = c.Registers()
+	if r[Y] != 5 {
+		t.Errorf("Expected Y=5 after three handler invocations, got: %v\n", r)
+	}
+}
+
+func TestIllegalOpcodes(t *testing.T) {
+	var faults []*Fault
+	c := new(DCPU16)
+	c.SetFaultFunc(func(f *Fault) { faults = append(faults, f) })
+	c.memory[0] = makeOpcode(EXT, 0x1f, A) // extended opcode 0x1f
+	c.memory[1] = makeOpcode(0x18, A, B)   // basic opcode 0x18
+	c.memory[2] = makeOpcode(EXT, IAG, A)  // IAG A
+
+	c.register[A] = 0x1234
+	e := c.Registers()
+	e[PC] = 1
+	e[TICK] = 1
+	if r := c.StepInfo(); !r.Illegal || r.ExtOpcode != 0x1f {
+		t.Errorf("Expected extended opcode 0x1f to be illegal, got %+v\n", r)
+	}
+	checkRegisters(e, c, t, "extended opcode 0x1f")
+
+	e[PC] = 2
+	e[TICK] = 2
+	if r := c.StepInfo(); !r.Illegal || r.Opcode != 0x18 {
+		t.Errorf("Expected opcode 0x18 to be illegal, got %+v\n", r)
+	}
+	checkRegisters(e, c, t, "opcode 0x18")
+
+	if r := c.StepInfo(); r.Illegal {
+		t.Errorf("Expected IAG to be legal, got %+v\n", r)
+	}
+
+	// an illegal opcode with a literal b operand
+	c.memory[3] = makeOpcode(0x19, 0x1f, A) // opcode 0x19 0x1234, A
+	c.memory[4] = 0x1234
+	if r := c.StepInfo(); !r.Illegal || r.Opcode != 0x19 {
+		t.Errorf("Expected opcode 0x19 with a literal b to be illegal, got %+v\n", r)
+	}
+
+	if len(faults) != 3 || faults[0].PC != 0 || faults[1].PC != 1 || faults[2].PC != 3 ||
+		faults[0].Reason != "illegal extended opcode 0x1f" || faults[1].Reason != "illegal opcode 0x18" ||
+		faults[2].Reason != "illegal opcode 0x19" {
+		t.Errorf("Expected faults at 0x0000, 0x0001 and 0x0003, got: %v\n", faults)
+	}
+}
+
+func TestTrapDivByZero(t *testing.T) {
+	var faults []*Fault
+	c := new(DCPU16)
+	c.SetFaultFunc(func(f *Fault) { faults = append(faults, f) })
+	c.memory[0] = makeOpcode(DIV, A, 0x21) // DIV A, 0
+
+	c.register[A] = 0x1234
+	c.ex = 0x5678
+	e := c.Registers()
+	e[A] = 0
+	e[EX] = 0
+	e[PC] = 1
+	e[TICK] = 3
+	c.step()
+	checkRegisters(e, c, t, "DIV A, 0")
+	if len(faults) != 0 {
+		t.Errorf("Expected no faults by default, got: %v\n", faults)
+	}
+
+	c.SetTrapDivByZero(true)
+	c.pc = 0
+	c.register[A] = 0x1234
+	c.ex = 0x5678
+	e[A] = 0x1234
+	e[EX] = 0x5678
+	e[TICK] = c.tick + 3
+	c.step()
+	checkRegisters(e, c, t, "DIV A, 0 (trapped)")
+	if len(faults) != 1 || faults[0].PC != 0 {
+		t.Errorf("Expected one fault at 0x0000, got: %v\n", faults)
+	}
+}
+
+func TestName(t *testing.T) {
+	var fault *Fault
+	c := new(DCPU16)
+	c.SetName("cpu1")
+	c.SetTrapDivByZero(true)
+	c.SetFaultFunc(func(f *Fault) { fault = f })
+	var trace bytes.Buffer
+	c.SetTraceWriter(&trace)
+	c.memory[0] = makeOpcode(MOD, A, 0x21) // MOD A, 0
+
+	if c.Name() != "cpu1" {
+		t.Errorf("Expected name cpu1, got %q\n", c.Name())
+	}
+	if s := c.Snapshot(); s.Name != "cpu1" {
+		t.Errorf("Expected the snapshot to be named cpu1, got %q\n", s.Name)
+	}
+	c.step()
+	if e := "cpu1: 0x0000: MOD A, 0x00\n"; trace.String() != e {
+		t.Errorf("Expected trace %q, got %q\n", e, trace.String())
+	}
+	if fault == nil || fault.Name != "cpu1" {
+		t.Fatalf("Expected a fault from cpu1, got: %v\n", fault)
+	}
+	if e := "cpu1: fault at 0x0000: division by zero"; fault.Error() != e {
+		t.Errorf("Expected %q, got %q\n", e, fault.Error())
+	}
+}
+
+func TestJSR(t *testing.T) {
+	c := new(DCPU16)
+	c.memory[0] = makeOpcode(EXT, JSR, 0x26) // JSR 5
+	e := c.Registers()
+	e[PC] = 5
+	e[SP] = 0xffff
+	e[TICK] = 3
+	c.step()
+	checkRegisters(e, c, t, "JSR 5")
+	if c.memory[0xffff] != 1 {
+		t.Errorf("Expected return address 0x0001 on the stack, got 0x%04x\n", c.memory[0xffff])
+	}
+
+	c.pc = 0
+	c.memory[0] = makeOpcode(EXT, JSR, 0x1f) // JSR 0x1234
+	c.memory[1] = 0x1234
+	e[PC] = 0x1234
+	e[SP] = 0xfffe
+	e[TICK] = c.tick + 4
+	c.step()
+	checkRegisters(e, c, t, "JSR 0x1234")
+	if c.memory[0xfffe] != 2 {
+		t.Errorf("Expected return address 0x0002 on the stack, got 0x%04x\n", c.memory[0xfffe])
+	}
+}
+
+func TestHWI(t *testing.T) {
+	c := new(DCPU16)
+	// HWI's extended opcode (0x12) is also the [next word + C] addressing
+	// mode, so it must not be resolved as an operand.
+	c.memory[0] = makeOpcode(EXT, HWI, 0x21) // HWI 0
+	c.memory[1] = makeOpcode(SET, A, 0x22)   // SET A, 1
+	e := c.Registers()
+	e[PC] = 1
+	e[TICK] = 4
+	c.step()
+	checkRegisters(e, c, t, "HWI 0")
+
+	e[A] = 1
+	e[PC] = 2
+	e[TICK] = 5
+	c.step()
+	checkRegisters(e, c, t, "SET A, 1")
+}
+
+func TestFaultSourceLine(t *testing.T) {
+	var fault *Fault
+	c := new(DCPU16)
+	c.SetTrapDivByZero(true)
+	c.SetFaultFunc(func(f *Fault) { fault = f })
+	c.SetDebugInfo(map[uint16]SourceLine{
+		0: {"prog.dasm", 3},
+		1: {"prog.dasm", 4},
+	})
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x23), // SET A, 2
+		makeOpcode(DIV, A, B),    // DIV A, B
+	})
+
+	c.step()
+	c.step()
+	if fault == nil {
+		t.Fatalf("Expected a fault\n")
+	}
+	if fault.Source.Line != 4 {
+		t.Errorf("Expected fault on line 4, got: %v\n", fault.Source)
+	}
+	if e := "fault at 0x0001: division by zero (prog.dasm:4)"; fault.Error() != e {
+		t.Errorf("Expected %q, got %q\n", e, fault.Error())
+	}
+}
+
+func TestStepOverAndOut(t *testing.T) {
+	mem := []uint16{
+		makeOpcode(SET, A, 0x22),    // SET A, 1
+		makeOpcode(EXT, JSR, 0x26),  // JSR sub
+		makeOpcode(SET, B, 0x23),    // SET B, 2
+		makeOpcode(SET, 0x1c, 0x24), // SET PC, 3
+		0,
+		makeOpcode(SET, PUSH, A),   // sub: SET PUSH, A
+		makeOpcode(EXT, JSR, 0x2a), // JSR sub2
+		makeOpcode(SET, C, POP),    // SET C, POP
+		makeOpcode(SET, 0x1c, POP), // SET PC, POP
+		makeOpcode(ADD, A, 0x22),   // sub2: ADD A, 1
+		makeOpcode(SET, 0x1c, POP), // SET PC, POP
+	}
+
+	c := new(DCPU16)
+	c.Write(0, mem)
+	if err := c.StepOver(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if r := c.Registers(); r[PC] != 1 {
+		t.Errorf("Expected StepOver of SET to stop at 0x0001, got: %v\n", r)
+	}
+	if err := c.StepOver(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	r := c.Registers()
+	if r[PC] != 2 || r[A] != 2 || r[C] != 1 || r[SP] != 0 {
+		t.Errorf("Expected StepOver of JSR to stop at 0x0002, got: %v\n", r)
+	}
+
+	c = new(DCPU16)
+	c.Write(0, mem)
+	c.step() // SET A, 1
+	c.step() // JSR sub
+	c.step() // SET PUSH, A
+	c.step() // JSR sub2
+	if err := c.StepOut(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if r := c.Registers(); r[PC] != 7 || r[A] != 2 || r[SP] != 0xfffe {
+		t.Errorf("Expected StepOut of sub2 to stop at 0x0007, got: %v\n", r)
+	}
+	if err := c.StepOut(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if r := c.Registers(); r[PC] != 2 || r[C] != 1 || r[SP] != 0 {
+		t.Errorf("Expected StepOut of sub to stop at 0x0002, got: %v\n", r)
+	}
+
+	// SET PC, 3 never returns; don't wait for it in real time
+	c.period = time.Nanosecond
+	if err := c.StepOut(); err != ErrNoReturn {
+		t.Errorf("Expected ErrNoReturn, got: %v\n", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	mem := []uint16{
+		0x7c01, 0x0030, 0x7de1, 0x1000, 0x0020, 0x7803, 0x1000, 0xc00d,
+		0x7dc1, 0x001a, 0xa861, 0x7c01, 0x2000, 0x2161, 0x2000, 0x8463,
+		0x806d, 0x7dc1, 0x000d, 0x9031, 0x7c10, 0x0018, 0x7dc1, 0x001a,
+		0x9037, 0x61c1, 0x7dc1, 0x001a,
+	}
+	const expect = 0xf7b0d33f
+
+	if f := Fingerprint(mem, 0, uint16(len(mem))); f != expect {
+		t.Errorf("Expected fingerprint 0x%08x, got 0x%08x\n", expect, f)
+	}
+	if f := Fingerprint(mem, 0, 0xffff); f != expect {
+		t.Errorf("Expected clamped fingerprint 0x%08x, got 0x%08x\n", expect, f)
+	}
+
+	c := new(DCPU16)
+	c.Write(0x100, mem)
+	f1 := c.Fingerprint()
+	c.Write(0x100+10, []uint16{0xa862})
+	if f2 := c.Fingerprint(); f1 == f2 {
+		t.Errorf("Expected a changed word to change the fingerprint\n")
+	}
+	c.Write(0x100+10, []uint16{0xa861})
+	if f3 := c.Fingerprint(); f1 != f3 {
+		t.Errorf("Expected fingerprint 0x%08x, got 0x%08x\n", f1, f3)
+	}
+}
+
+// stubDevice is a Device for testing the hardware instructions.
+type stubDevice struct {
+	id, manufacturer uint32
+	version          uint16
+	interrupt        func(c *DCPU16)
+	cost             uint16 // extra cycles taken by Interrupt
+}
+
+func (d *stubDevice) ID() uint32           { return d.id }
+func (d *stubDevice) Version() uint16      { return d.version }
+func (d *stubDevice) Manufacturer() uint32 { return d.manufacturer }
+
+func (d *stubDevice) Interrupt(c *DCPU16) uint16 {
+	if d.interrupt != nil {
+		d.interrupt(c)
+	}
+	return d.cost
+}
+
+func TestAttachHardware(t *testing.T) {
+	c := new(DCPU16)
+	for i := 0; i < 2; i++ {
+		index, err := c.AttachHardware(&stubDevice{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		if index != uint16(i) {
+			t.Errorf("Expected index %d, got %d\n", i, index)
+		}
+	}
+
+	// HWN can report at most 0xffff devices, so index 0xffff is never used
+	c.hardware = make([]Device, LASTADDR-1)
+	if index, err := c.AttachHardware(&stubDevice{}); err != nil || index != 0xfffe {
+		t.Errorf("Expected index 0xfffe, got 0x%04x (%v)\n", index, err)
+	}
+	if _, err := c.AttachHardware(&stubDevice{}); err != ErrTooManyDevices {
+		t.Errorf("Expected ErrTooManyDevices, got %v\n", err)
+	}
+	if len(c.hardware) != LASTADDR {
+		t.Errorf("Expected %d devices, got %d\n", LASTADDR, len(c.hardware))
+	}
+}
+
+func TestHWN(t *testing.T) {
+	c := new(DCPU16)
+	c.hardware = []Device{&stubDevice{}, &stubDevice{}}
+	c.memory[0] = makeOpcode(EXT, HWN, A) // HWN A
+	e := c.Registers()
+	e[A] = 2
+	e[PC] = 1
+	e[TICK] = 2
+	c.step()
+	checkRegisters(e, c, t, "HWN A")
+}
+
+func TestHWQ(t *testing.T) {
+	c := new(DCPU16)
+	c.AttachHardware(&stubDevice{id: 0x7349f615, version: 0x1802, manufacturer: 0x1c6c8b36})
+	c.memory[0] = makeOpcode(EXT, HWQ, 0x21) // HWQ 0
+	c.memory[1] = makeOpcode(EXT, HWQ, 0x22) // HWQ 1
+	e := c.Registers()
+	e[A] = 0xf615
+	e[B] = 0x7349
+	e[C] = 0x1802
+	e[X] = 0x8b36
+	e[Y] = 0x1c6c
+	e[PC] = 1
+	e[TICK] = 4
+	c.step()
+	checkRegisters(e, c, t, "HWQ 0")
+
+	// no device at index 1
+	e[A], e[B], e[C], e[X], e[Y] = 0, 0, 0, 0, 0
+	e[PC] = 2
+	e[TICK] = 8
+	c.step()
+	checkRegisters(e, c, t, "HWQ 1")
+}
+
+func TestHWIDispatch(t *testing.T) {
+	c := new(DCPU16)
+	c.AttachHardware(&stubDevice{interrupt: func(c *DCPU16) {
+		c.register[C] = c.register[B]
+	}})
+	c.register[B] = 0x1234
+	c.memory[0] = makeOpcode(EXT, HWI, 0x21) // HWI 0
+	c.memory[1] = makeOpcode(EXT, HWI, 0x22) // HWI 1
+	e := c.Registers()
+	e[C] = 0x1234
+	e[PC] = 1
+	e[TICK] = 4
+	c.step()
+	checkRegisters(e, c, t, "HWI 0")
+
+	// no device at index 1
+	c.register[B] = 0
+	e[B] = 0
+	e[PC] = 2
+	e[TICK] = 8
+	c.step()
+	checkRegisters(e, c, t, "HWI 1")
+}
+
+func TestHWICost(t *testing.T) {
+	c := new(DCPU16)
+	c.SetClockRate(0)
+	c.AttachHardware(&stubDevice{cost: 1024})
+	c.memory[0] = makeOpcode(EXT, HWI, 0x21) // HWI 0
+	e := c.Registers()
+	e[PC] = 1
+	e[TICK] = 4 + 1024
+	if r := c.StepInfo(); r.Cycles != 4+1024 {
+		t.Errorf("Expected HWI to take %d cycles, got %d\n", 4+1024, r.Cycles)
+	}
+	checkRegisters(e, c, t, "HWI 0")
+}
+
+func TestReset(t *testing.T) {
+	c := NewDCPU16()
+	c.period = time.Nanosecond
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x1f), 0x1234, // SET A, 0x1234
+		makeOpcode(SET, PUSH, A), // SET PUSH, A
+		makeOpcode(EXT, IAS, A),  // IAS A
+		makeOpcode(EXT, IAQ, A),  // IAQ A
+	})
+	for i := 0; i < 4; i++ {
+		c.Step()
+	}
+	c.Stop()
+
+	c.Reset()
+	if c.TotalCycles() != 0 {
+		t.Errorf("Expected the cycle count to be cleared, got %d\n", c.TotalCycles())
+	}
+	if c.TimingSkew() != 0 {
+		t.Errorf("Expected the timing skew to be cleared, got %v\n", c.TimingSkew())
+	}
+	if c.stopRequested() {
+		t.Errorf("Expected Reset to clear a pending Stop\n")
+	}
+	for i, v := range c.Registers() {
+		if v != 0 {
+			t.Errorf("Expected register %d to be 0, got 0x%04x\n", i, v)
+		}
+	}
+	if v := c.Read(0, 1)[0]; v != 0 {
+		t.Errorf("Expected memory to be cleared, got 0x%04x at 0x0000\n", v)
+	}
+	if v := c.Read(LASTADDR, 1)[0]; v != 0 {
+		t.Errorf("Expected memory to be cleared, got 0x%04x at 0x%04x\n", v, LASTADDR)
+	}
+}
+
+func TestStop(t *testing.T) {
+	c := NewDCPU16()
+	c.period = time.Nanosecond
+	done := make(chan bool)
+	go func() {
+		c.Run()
+		done <- true
+	}()
+
+	c.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Expected Run to return after Stop\n")
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	c := NewDCPU16()
+	c.period = time.Nanosecond
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := c.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v\n", err)
+	}
+}
+
+func TestSetClockRate(t *testing.T) {
+	const n = 1000
+
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	c.memory[0] = makeOpcode(SET, 0x1c, 0x21) // SET PC, 0
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		c.Step()
+	}
+	if d := time.Since(start); d > n*time.Millisecond/10 {
+		t.Errorf("Expected %d unthrottled steps to take well under %v, took %v\n", n, n*time.Millisecond, d)
+	}
+
+	c.SetClockRate(100000)
+	if c.unlimited || c.cycleDuration() != 10*time.Microsecond {
+		t.Errorf("Expected a cycle duration of 10us, got %v\n", c.cycleDuration())
+	}
+}
+
+func TestStepN(t *testing.T) {
+	c := new(DCPU16)
+	c.period = time.Nanosecond
+	c.memory[0] = makeOpcode(ADD, A, 0x22)    // ADD A, 1
+	c.memory[1] = makeOpcode(SET, 0x1c, 0x21) // SET PC, 0
+	e := c.Registers()
+	e[A] = 2
+	e[PC] = 1
+	e[TICK] = 5
+
+	if n := c.StepN(3); n != 3 {
+		t.Errorf("Expected 3 instructions to be executed, got %d\n", n)
+	}
+	checkRegisters(e, c, t, "StepN(3)")
+}
+
+func BenchmarkStep(b *testing.B) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	c.memory[0] = makeOpcode(SET, 0x1c, 0x21) // SET PC, 0
+	for i := 0; i < b.N; i++ {
+		c.Step()
+	}
+}
+
+func TestStepNThrottled(t *testing.T) {
+	c := NewDCPU16()
+	c.SetClockRate(1000)
+	c.Write(0, []uint16{
+		makeOpcode(ADD, A, 0x22),    // :loop ADD A, 1 (2 cycles)
+		makeOpcode(SET, 0x1c, 0x21), // SET PC, loop (1 cycle)
+	})
+
+	// 40 instructions take 60 cycles, or 60ms at 1kHz
+	start := time.Now()
+	c.StepN(40)
+	d := time.Since(start)
+	if want := 60 * time.Millisecond; d < want || d > 2*want {
+		t.Errorf("Expected StepN(40) at 1kHz to take about %v, took %v\n", want, d)
+	}
+}
+
+func BenchmarkStepN(b *testing.B) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	c.memory[0] = makeOpcode(SET, 0x1c, 0x21) // SET PC, 0
+	c.StepN(b.N)
+}
+
+func TestStepInfo(t *testing.T) {
+	c := NewDCPU16()
+	c.period = time.Nanosecond
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x1f), 0x0030, // SET A, 0x30
+		makeOpcode(IFE, A, 0x21), // IFE A, 0
+		makeOpcode(EXT, JSR, A),  // JSR A
+	})
+
+	r := c.StepInfo()
+	e := StepResult{PC: 0, Opcode: SET, A: 0x30, Cycles: 2}
+	if r != e {
+		t.Errorf("SET A, 0x30: expected %+v, got %+v\n", e, r)
+	}
+
+	r = c.StepInfo()
+	e = StepResult{PC: 2, Opcode: IFE, A: 0, B: 0x30, Cycles: 3, Skipped: true}
+	if r != e {
+		t.Errorf("IFE A, 0: expected %+v, got %+v\n", e, r)
+	}
+}
+
+func TestMapMemory(t *testing.T) {
+	var writes [][2]uint16
+	c := new(DCPU16)
+	c.MapMemory(0x8000, 0x817f, func(addr, val uint16) {
+		writes = append(writes, [2]uint16{addr, val})
+	})
+	c.register[I] = 0x8001
+	c.memory[0] = makeOpcode(SET, 0x1e, 0x1f) // SET [0x8000], 0x41
+	c.memory[1] = 0x0041
+	c.memory[2] = 0x8000
+	c.memory[3] = makeOpcode(ADD, 0x0e, 0x22) // ADD [I], 1
+	c.memory[4] = makeOpcode(SET, 0x1e, 0x22) // SET [0x9000], 1
+	c.memory[5] = 0x9000
+	c.memory[6] = makeOpcode(IFE, 0x0e, 0x22) // IFE [I], 1
+	c.step()
+	c.step()
+	c.step()
+	c.step()
+
+	e := [][2]uint16{{0x8000, 0x41}, {0x8001, 1}}
+	if fmt.Sprint(writes) != fmt.Sprint(e) {
+		t.Errorf("Expected writes %v, got %v\n", e, writes)
+	}
+}
+
+func TestMapMemoryNoWrite(t *testing.T) {
+	var writes [][2]uint16
+	c := new(DCPU16)
+	c.MapMemory(0x8000, 0x817f, func(addr, val uint16) {
+		writes = append(writes, [2]uint16{addr, val})
+	})
+	c.SetWatchpoint(0x8000, false, true)
+	c.SetTrapDivByZero(true)
+	c.memory[0] = makeOpcode(0x18, 0x1e, 0x22) // illegal opcode 0x18 [0x8000], 1
+	c.memory[1] = 0x8000
+	c.memory[2] = makeOpcode(DIV, 0x1e, 0x21) // DIV [0x8000], 0 (trapped)
+	c.memory[3] = 0x8000
+	for i := 0; i < 2; i++ {
+		c.step()
+		if c.watchHit {
+			t.Errorf("instruction %d: Expected no write watchpoint hit\n", i)
+		}
+	}
+
+	if len(writes) != 0 {
+		t.Errorf("Expected no writes, got %v\n", writes)
+	}
+}
+
+func TestMapMemoryRead(t *testing.T) {
+	rx := []uint16{'H', 'i', '!'}
+	reads := 0
+	c := new(DCPU16)
+	c.MapMemoryRead(0x9000, 0x9000, func(addr uint16) uint16 {
+		reads++
+		if len(rx) == 0 {
+			return 0
+		}
+		v := rx[0]
+		rx = rx[1:]
+		return v
+	})
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x1e), 0x9000, // SET A, [0x9000]
+		makeOpcode(SET, B, 0x1e), 0x9000, // SET B, [0x9000]
+		makeOpcode(SET, 0x1e, 0x26), 0x9000, // SET [0x9000], 5
+		makeOpcode(ADD, 0x1e, 0x22), 0x9000, // ADD [0x9000], 1
+		makeOpcode(SET, C, 0x1e), 0x9000, // SET C, [0x9000]
+	})
+	for i := 0; i < 5; i++ {
+		c.step()
+	}
+
+	if c.register[A] != 'H' || c.register[B] != 'i' || c.register[C] != 0 {
+		t.Errorf("Expected A='H', B='i', C=0, got: %v\n", c.register)
+	}
+	if reads != 4 {
+		t.Errorf("Expected 4 reads (none by SET [0x9000]), got %d\n", reads)
+	}
+	if v := c.memory[0x9000]; v != '!'+1 {
+		t.Errorf("Expected ADD to store the byte read plus 1, got 0x%04x\n", v)
+	}
+}
+
+func TestSetTraceFunc(t *testing.T) {
+	var pcs, words []uint16
+	c := new(DCPU16)
+	c.period = time.Nanosecond
+	c.SetTraceFunc(func(pc, opcode uint16) {
+		pcs = append(pcs, pc)
+		words = append(words, opcode)
+	})
+	c.memory[0] = makeOpcode(SET, A, 0x1f) // SET A, 0x0030
+	c.memory[1] = 0x0030
+	c.memory[2] = makeOpcode(IFE, A, 0x21)    // IFE A, 0
+	c.memory[3] = makeOpcode(ADD, A, 0x22)    // ADD A, 1
+	c.memory[4] = makeOpcode(SET, 0x1c, 0x21) // SET PC, 0
+	for i := 0; i < 4; i++ {
+		c.Step()
+	}
+
+	e := []uint16{0, 2, 4, 0}
+	if fmt.Sprint(pcs) != fmt.Sprint(e) {
+		t.Errorf("Expected PCs %v, got %v\n", e, pcs)
+	}
+	if words[1] != c.memory[2] {
+		t.Errorf("Expected opcode 0x%04x, got 0x%04x\n", c.memory[2], words[1])
+	}
+
+	c.SetTraceFunc(nil)
+	c.Step()
+	if len(pcs) != 4 {
+		t.Errorf("Expected tracing to be disabled\n")
+	}
+}
+
+func TestBreakpoint(t *testing.T) {
+	c := NewDCPU16()
+	c.period = time.Nanosecond
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x2b),    // SET A, 10
+		makeOpcode(SUB, A, 0x22),    // :loop SUB A, 1
+		makeOpcode(IFN, A, 0x21),    // IFN A, 0
+		makeOpcode(SET, 0x1c, 0x22), // SET PC, loop
+		makeOpcode(SET, B, A),       // SET B, A
+	})
+	c.SetBreakpoint(1)
+
+	for _, e := range []uint16{10, 9} {
+		addr, ok := c.RunUntilBreak()
+		if !ok || addr != 1 {
+			t.Fatalf("Expected to stop at breakpoint 0x0001, got 0x%04x (%v)\n", addr, ok)
+		}
+		if a := c.Registers()[A]; a != e {
+			t.Errorf("Expected A to be %d at the breakpoint, got %d\n", e, a)
+		}
+	}
+
+	c.ClearBreakpoint(1)
+	c.SetBreakpoint(5)
+	if addr, ok := c.RunUntilBreak(); !ok || addr != 5 {
+		t.Fatalf("Expected to stop at breakpoint 0x0005, got 0x%04x (%v)\n", addr, ok)
+	}
+	if a := c.Registers()[A]; a != 0 {
+		t.Errorf("Expected the loop to finish with A = 0, got %d\n", a)
+	}
+}
+
+func TestWatchpoint(t *testing.T) {
+	c := NewDCPU16()
+	c.period = time.Nanosecond
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x1e), 0x1000, // SET A, [0x1000]
+		makeOpcode(ADD, A, 0x22),         // ADD A, 1
+		makeOpcode(SET, 0x1e, A), 0x1000, // SET [0x1000], A
+		makeOpcode(SET, 0x1c, 0x21), // SET PC, 0
+	})
+
+	c.SetWatchpoint(0x1000, false, true)
+	if pc, ok := c.RunUntilBreak(); !ok || pc != 5 {
+		t.Fatalf("Expected to stop at 0x0005, got 0x%04x (%v)\n", pc, ok)
+	}
+	if addr, kind := c.LastWatchpoint(); addr != 0x1000 || kind != WATCH_WRITE {
+		t.Errorf("Expected a write to 0x1000, got 0x%04x (%d)\n", addr, kind)
+	}
+	if v := c.Read(0x1000, 1)[0]; v != 1 {
+		t.Errorf("Expected 1 at 0x1000, got %d\n", v)
+	}
+
+	c.SetWatchpoint(0x1000, true, false)
+	if pc, ok := c.RunUntilBreak(); !ok || pc != 2 {
+		t.Fatalf("Expected to stop at 0x0002, got 0x%04x (%v)\n", pc, ok)
+	}
+	if addr, kind := c.LastWatchpoint(); addr != 0x1000 || kind != WATCH_READ {
+		t.Errorf("Expected a read of 0x1000, got 0x%04x (%d)\n", addr, kind)
+	}
+}
+
+func TestSkipMultiWord(t *testing.T) {
+	c := new(DCPU16)
+	c.memory[0] = makeOpcode(IFE, A, 0x22)    // IFE A, 1
+	c.memory[1] = makeOpcode(SET, 0x1e, 0x1f) // SET [0x1000], 0x20
+	c.memory[2] = 0x0020
+	c.memory[3] = 0x1000
+	e := c.Registers()
+	e[PC] = 4
+	e[TICK] = 3
+	c.step()
+	checkRegisters(e, c, t, "IFE A, 1; SET [0x1000], 0x20")
+
+	// chained conditionals skip the whole chain
+	c = new(DCPU16)
+	c.memory[0] = makeOpcode(IFE, A, 0x22) // IFE A, 1
+	c.memory[1] = makeOpcode(IFN, A, 0x1e) // IFN A, [0x1000]
+	c.memory[2] = 0x1000
+	c.memory[3] = makeOpcode(SET, 0x1e, 0x1f) // SET [0x1000], 0x20
+	c.memory[4] = 0x0020
+	c.memory[5] = 0x1000
+	e = c.Registers()
+	e[PC] = 6
+	e[TICK] = 4
+	c.step()
+	checkRegisters(e, c, t, "IFE A, 1; IFN A, [0x1000]; SET [0x1000], 0x20")
+}
+
+func TestWriteEndOfMemory(t *testing.T) {
+	c := NewDCPU16()
+	if n := c.Write(0xfffe, []uint16{1, 2, 3, 4}); n != 2 {
+		t.Errorf("Expected 2 words to be written, got %d\n", n)
+	}
+	if m := c.Read(0xfffe, 2); m[0] != 1 || m[1] != 2 {
+		t.Errorf("Expected [1 2] at 0xfffe, got %v\n", m)
+	}
+	if n := c.Write(0, []uint16{1, 2, 3, 4}); n != 4 {
+		t.Errorf("Expected 4 words to be written, got %d\n", n)
+	}
+}
+
+func TestAddressWraparound(t *testing.T) {
+	c := new(DCPU16)
+	c.memory[1] = 0x1234
+	c.register[B] = 2
+	c.memory[2] = makeOpcode(SET, A, 0x11) // SET A, [0xffff+B]
+	c.memory[3] = 0xffff
+	c.pc = 2
+	e := c.Registers()
+	e[A] = 0x1234
+	e[PC] = 4
+	e[TICK] = 2
+	c.step()
+	checkRegisters(e, c, t, "SET A, [0xffff+B]")
+
+	c.sp = 0xfffe
+	c.memory[4] = makeOpcode(SET, C, 0x1a) // SET C, PICK 3
+	c.memory[5] = 3
+	e[C] = 0x1234
+	e[SP] = 0xfffe
+	e[PC] = 6
+	e[TICK] = 4
+	c.step()
+	checkRegisters(e, c, t, "SET C, PICK 3")
+}
+
+func TestInterruptDiscard(t *testing.T) {
+	c := new(DCPU16)
+	c.register[A] = 5
+	c.memory[0] = makeOpcode(EXT, INT, 0x22) // INT 1
+	e := c.Registers()
+	e[PC] = 1
+	e[TICK] = 4
+	c.step()
+	checkRegisters(e, c, t, "INT 1 (IA=0)")
+	if len(c.intQueue) != 0 {
+		t.Errorf("Expected the interrupt to be discarded, got queue %v\n", c.intQueue)
+	}
+}
+
+func TestInterruptQueueOrder(t *testing.T) {
+	c := new(DCPU16)
+	c.register[I] = 0x1000
+	c.Write(0, []uint16{
+		makeOpcode(EXT, IAS, 0x31), // IAS 0x10
+		makeOpcode(SET, A, 0x26),   // SET A, 5
+		makeOpcode(EXT, IAQ, 0x22), // IAQ 1
+		makeOpcode(EXT, INT, 0x22), // INT 1
+		makeOpcode(EXT, INT, 0x23), // INT 2
+		makeOpcode(EXT, IAQ, 0x21), // IAQ 0
+	})
+	c.Write(0x10, []uint16{
+		makeOpcode(SET, 0x0e, A),   // SET [I], A
+		makeOpcode(ADD, I, 0x22),   // ADD I, 1
+		makeOpcode(EXT, RFI, 0x21), // RFI 0
+	})
+
+	for i := 0; i < 5; i++ {
+		c.step()
+	}
+	if r := c.Registers(); r[PC] != 5 || len(c.intQueue) != 2 {
+		t.Fatalf("Expected both interrupts to be queued, got %v (queue %v)\n", r, c.intQueue)
+	}
+
+	c.step() // IAQ 0, dispatching INT 1
+	r := c.Registers()
+	if r[PC] != 0x10 || r[A] != 1 || r[IQ] != 1 {
+		t.Errorf("Expected handler entry with A=1 and queueing on, got %v\n", r)
+	}
+	if r[SP] != 0xfffe || c.memory[0xffff] != 6 || c.memory[0xfffe] != 5 {
+		t.Errorf("Expected PC=6, A=5 on the stack, got SP=0x%04x %v\n", r[SP], c.memory[0xfffe:])
+	}
+
+	for i := 0; i < 6; i++ {
+		c.step()
+	}
+	r = c.Registers()
+	if c.memory[0x1000] != 1 || c.memory[0x1001] != 2 {
+		t.Errorf("Expected interrupts 1, 2 in order, got %v\n", c.memory[0x1000:0x1002])
+	}
+	if r[PC] != 6 || r[A] != 5 || r[SP] != 0 || r[IQ] != 0 {
+		t.Errorf("Expected to return to PC=6 with A=5, got %v\n", r)
+	}
+}
+
+func TestTriggerInterrupt(t *testing.T) {
+	c := NewDCPU16()
+	c.AttachHardware(&stubDevice{interrupt: func(c *DCPU16) {
+		if err := c.TriggerInterrupt(0x42); err != nil {
+			t.Errorf("Unexpected error: %v\n", err)
+		}
+	}})
+	c.ia = 0x10
+	c.memory[0] = makeOpcode(EXT, HWI, 0x21) // HWI 0
+	c.step()
+	if r := c.Registers(); r[PC] != 0x10 || r[A] != 0x42 || r[IQ] != 1 {
+		t.Errorf("Expected the device's interrupt to be dispatched, got %v\n", r)
+	}
+
+	for i := 0; i < MAX_INTQUEUE; i++ {
+		if err := c.TriggerInterrupt(uint16(i)); err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+	}
+	if err := c.TriggerInterrupt(0); err != ErrInterruptQueueFull {
+		t.Errorf("Expected ErrInterruptQueueFull, got %v\n", err)
+	}
+}
+
+func TestCaughtFire(t *testing.T) {
+	c := NewDCPU16()
+	c.period = time.Nanosecond
+	c.Write(0, []uint16{
+		makeOpcode(EXT, IAQ, 0x22),  // IAQ 1
+		makeOpcode(EXT, INT, 0x22),  // :loop INT 1
+		makeOpcode(SET, 0x1c, 0x22), // SET PC, loop
+	})
+
+	done := make(chan bool)
+	go func() {
+		c.Run()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Stop()
+		t.Fatalf("Expected Run to return when the CPU caught fire\n")
+	}
+
+	if !c.CaughtFire() {
+		t.Errorf("Expected the CPU to have caught fire\n")
+	}
+	if n := c.StepN(10); n != 0 {
+		t.Errorf("Expected no instructions to be executed, got %d\n", n)
+	}
+	c.Reset()
+	if c.CaughtFire() {
+		t.Errorf("Expected Reset to put out the fire\n")
+	}
+}
+
+func TestInterruptOverflowFunc(t *testing.T) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, []uint16{
+		makeOpcode(EXT, IAQ, 0x22),  // IAQ 1
+		makeOpcode(EXT, INT, 0x22),  // :loop INT 1
+		makeOpcode(SET, 0x1c, 0x22), // SET PC, loop
+	})
+	overflows := 0
+	c.SetInterruptOverflowFunc(func(queued int) {
+		if queued != MAX_INTQUEUE {
+			t.Errorf("Expected %d queued interrupts, got %d\n", MAX_INTQUEUE, queued)
+		}
+		overflows++
+	})
+
+	c.StepN(1 + 2*(MAX_INTQUEUE+10))
+	if overflows != 10 {
+		t.Errorf("Expected 10 overflows, got %d\n", overflows)
+	}
+	if c.CaughtFire() {
+		t.Errorf("Expected the CPU not to catch fire with an overflow function\n")
+	}
+	if err := c.TriggerInterrupt(2); err != ErrInterruptQueueFull || overflows != 11 {
+		t.Errorf("Expected TriggerInterrupt to overflow, got %v after %d overflows\n", err, overflows)
+	}
+}
+
+func TestNamedRegisters(t *testing.T) {
+	c := NewDCPU16()
+	if !c.SetRegister("PC", 0x1234) {
+		t.Fatalf("Expected PC to be a register\n")
+	}
+	if pc := c.Registers()[PC]; pc != 0x1234 {
+		t.Errorf("Expected PC to be 0x1234, got 0x%04x\n", pc)
+	}
+
+	c.SetRegister("x", 7)
+	if v, ok := c.GetRegister("X"); !ok || v != 7 {
+		t.Errorf("Expected X to be 7, got %d (%v)\n", v, ok)
+	}
+	if v := c.Registers()[X]; v != 7 {
+		t.Errorf("Expected X to be 7, got %d\n", v)
+	}
+
+	for _, name := range []string{"", "Q", "AB", "TICK"} {
+		if _, ok := c.GetRegister(name); ok {
+			t.Errorf("Expected %q not to be a register\n", name)
+		}
+		if c.SetRegister(name, 0) {
+			t.Errorf("Expected setting %q to fail\n", name)
+		}
+	}
+}
+
+func BenchmarkArithmeticLoop(b *testing.B) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, []uint16{
+		makeOpcode(ADD, A, 0x22),    // :loop ADD A, 1
+		makeOpcode(MUL, B, A),       // MUL B, A
+		makeOpcode(XOR, C, B),       // XOR C, B
+		makeOpcode(SHR, C, 0x22),    // SHR C, 1
+		makeOpcode(IFN, A, 0x21),    // IFN A, 0
+		makeOpcode(SET, 0x1c, 0x21), // SET PC, loop
+		makeOpcode(SET, 0x1c, 0x21), // SET PC, loop
+	})
+	b.ResetTimer()
+	c.StepN(b.N)
+}
+
+// dispatchOps are the opcodes executed by the dispatch benchmarks.
+var dispatchOps = []uint16{ADD, MUL, XOR, SHR, SUB, AND, BOR, SET}
+
+// dispatchSwitch executes opcode with a switch, as execute did before the
+// basicOps table, for comparison with the table in BenchmarkDispatchTable.
+func dispatchSwitch(c *DCPU16, opcode uint16, a, b *uint16) bool {
+	switch opcode {
+	case SET:
+		return opSET(c, a, b)
+	case ADD:
+		return opADD(c, a, b)
+	case SUB:
+		return opSUB(c, a, b)
+	case MUL:
+		return opMUL(c, a, b)
+	case MLI:
+		return opMLI(c, a, b)
+	case DIV:
+		return opDIV(c, a, b)
+	case DVI:
+		return opDVI(c, a, b)
+	case MOD:
+		return opMOD(c, a, b)
+	case MDI:
+		return opMDI(c, a, b)
+	case AND:
+		return opAND(c, a, b)
+	case BOR:
+		return opBOR(c, a, b)
+	case XOR:
+		return opXOR(c, a, b)
+	case SHR:
+		return opSHR(c, a, b)
+	case ASR:
+		return opASR(c, a, b)
+	case SHL:
+		return opSHL(c, a, b)
+	case IFB:
+		return opIFB(c, a, b)
+	case IFC:
+		return opIFC(c, a, b)
+	case IFE:
+		return opIFE(c, a, b)
+	case IFN:
+		return opIFN(c, a, b)
+	case IFG:
+		return opIFG(c, a, b)
+	case IFA:
+		return opIFA(c, a, b)
+	case IFL:
+		return opIFL(c, a, b)
+	case IFU:
+		return opIFU(c, a, b)
+	case ADX:
+		return opADX(c, a, b)
+	case SBX:
+		return opSBX(c, a, b)
+	case STI:
+		return opSTI(c, a, b)
+	case STD:
+		return opSTD(c, a, b)
+	}
+	return false
+}
+
+func BenchmarkDispatchSwitch(b *testing.B) {
+	c := NewDCPU16()
+	x, y := uint16(3), uint16(5)
+	for i := 0; i < b.N; i++ {
+		dispatchSwitch(c, dispatchOps[i%len(dispatchOps)], &x, &y)
+	}
+}
+
+func BenchmarkDispatchTable(b *testing.B) {
+	c := NewDCPU16()
+	x, y := uint16(3), uint16(5)
+	for i := 0; i < b.N; i++ {
+		basicOps[dispatchOps[i%len(dispatchOps)]](c, &x, &y)
+	}
+}
+
+func TestRegistersInto(t *testing.T) {
+	c := NewDCPU16()
+	c.register[A] = 1
+	c.register[J] = 2
+	c.sp = 0xfff0
+	c.intQueueing = true
+
+	r := make([]uint16, regSize)
+	if n := c.RegistersInto(r); n != regSize {
+		t.Errorf("Expected %d registers, got %d\n", regSize, n)
+	}
+	if e := c.Registers(); !reflect.DeepEqual(r, e) {
+		t.Errorf("Expected %v, got %v\n", e, r)
+	}
+	short := make([]uint16, 2)
+	if n := c.RegistersInto(short); n != 2 || short[A] != 1 {
+		t.Errorf("Expected 2 registers with A=1, got %d: %v\n", n, short)
+	}
+}
+
+func TestReadInto(t *testing.T) {
+	c := NewDCPU16()
+	c.Write(LASTADDR-1, []uint16{1, 2})
+
+	d := make([]uint16, 4)
+	if n := c.ReadInto(LASTADDR-1, d); n != 2 {
+		t.Errorf("Expected 2 words, got %d\n", n)
+	}
+	if e := []uint16{1, 2, 0, 0}; !reflect.DeepEqual(d, e) {
+		t.Errorf("Expected %v, got %v\n", e, d)
+	}
+}
+
+func TestPeekPoke(t *testing.T) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	c.Poke(LASTADDR, 0xbeef)
+	if v := c.Peek(LASTADDR); v != 0xbeef {
+		t.Errorf("Expected 0xbeef, got 0x%04x\n", v)
+	}
+
+	c.Poke(0, makeOpcode(SET, A, 0x1e)) // SET A, [0x1000]
+	c.Poke(1, 0x1000)
+	c.Poke(0x1000, 0x1234)
+	c.Step()
+	if a := c.Registers()[A]; a != 0x1234 {
+		t.Errorf("Expected A to be 0x1234, got 0x%04x\n", a)
+	}
+}
+
+func TestStack(t *testing.T) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, []uint16{
+		makeOpcode(SET, PUSH, 0x22), // SET PUSH, 1
+		makeOpcode(SET, PUSH, 0x23), // SET PUSH, 2
+		makeOpcode(EXT, JSR, 0x25),  // JSR 4
+		0,                           // :sub at 4
+	})
+	if s := c.Stack(3); len(s) != 0 {
+		t.Errorf("Expected an empty stack, got %v\n", s)
+	}
+
+	c.StepN(3)
+	if s, e := c.Stack(3), []uint16{3, 2, 1}; !reflect.DeepEqual(s, e) {
+		t.Errorf("Expected stack %v, got %v\n", e, s)
+	}
+	if s, e := c.Stack(2), []uint16{3, 2}; !reflect.DeepEqual(s, e) {
+		t.Errorf("Expected stack %v, got %v\n", e, s)
+	}
+	if s := c.Stack(10); len(s) != 3 {
+		t.Errorf("Expected the whole stack of 3 words, got %v\n", s)
+	}
+}
+
+func TestStateHash(t *testing.T) {
+	program := []uint16{
+		makeOpcode(SET, I, 0x2b),    // SET I, 10
+		makeOpcode(SET, 0x10+I, I),  // :loop SET [0x1000+I], I
+		0x1000,                      //
+		makeOpcode(SUB, I, 0x22),    // SUB I, 1
+		makeOpcode(IFN, I, 0x21),    // IFN I, 0
+		makeOpcode(SET, 0x1c, 0x22), // SET PC, loop
+	}
+	run := func(program []uint16) *DCPU16 {
+		c := NewDCPU16()
+		c.SetClockRate(0)
+		c.Write(0, program)
+		c.StepN(41)
+		return c
+	}
+
+	c1, c2 := run(program), run(program)
+	if h1, h2 := c1.StateHash(), c2.StateHash(); h1 != h2 {
+		t.Errorf("Expected identical hashes, got 0x%016x and 0x%016x\n", h1, h2)
+	}
+
+	program[0] = makeOpcode(SET, I, 0x2a) // SET I, 9
+	c3 := run(program)
+	if h1, h3 := c1.StateHash(), c3.StateHash(); h1 == h3 {
+		t.Errorf("Expected different hashes for a different program, got 0x%016x\n", h1)
+	}
+}
+
+func BenchmarkRegistersInto(b *testing.B) {
+	c := NewDCPU16()
+	r := make([]uint16, regSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.RegistersInto(r)
+	}
+}
+
+func BenchmarkReadInto(b *testing.B) {
+	c := NewDCPU16()
+	d := make([]uint16, 256)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.ReadInto(0x8000, d)
+	}
+}
+
+func TestThrottleUnlocked(t *testing.T) {
+	c := NewDCPU16()
+	c.SetClockRate(4) // 250ms per cycle
+	c.Write(0, []uint16{
+		makeOpcode(EXT, IAS, 0x22),  // IAS 1, so that the loop doesn't halt
+		makeOpcode(SET, 0x1c, 0x22), // :spin SET PC, spin
+	})
+
+	done := make(chan bool)
+	go func() {
+		c.Run()
+		done <- true
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	c.Registers()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Expected Registers to return promptly, took %v\n", d)
+	}
+
+	c.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Expected Run to return after Stop\n")
+	}
+}
+
+func TestSetRealtime(t *testing.T) {
+	program := []uint16{
+		makeOpcode(SET, I, 0x2b),    // SET I, 10
+		makeOpcode(SUB, I, 0x22),    // :loop SUB I, 1
+		makeOpcode(IFN, I, 0x21),    // IFN I, 0
+		makeOpcode(SET, 0x1c, 0x22), // SET PC, loop
+	}
+	const n = 31 // instructions executed, ending with the final skip
+
+	run := func(realtime bool) (tick uint16, d time.Duration) {
+		c := NewDCPU16()
+		c.SetClockRate(1000) // 1ms per cycle
+		c.SetRealtime(realtime)
+		c.Write(0, program)
+		start := time.Now()
+		c.StepN(n)
+		return c.Registers()[TICK], time.Since(start)
+	}
+
+	tick1, d1 := run(true)
+	tick2, d2 := run(false)
+	if tick1 != tick2 {
+		t.Errorf("Expected identical tick counts, got %d realtime and %d not\n", tick1, tick2)
+	}
+	if d1 < time.Duration(tick1)*time.Millisecond {
+		t.Errorf("Expected realtime to take at least %dms, took %v\n", tick1, d1)
+	}
+	if d2 >= d1/2 {
+		t.Errorf("Expected non-realtime (%v) to be much faster than realtime (%v)\n", d2, d1)
+	}
+
+	// turning realtime back on keeps a clock rate of 0
+	c := NewDCPU16()
+	c.SetClockRate(1000)
+	c.SetClockRate(0)
+	c.SetRealtime(false)
+	c.SetRealtime(true)
+	c.Write(0, program)
+	start := time.Now()
+	c.StepN(n)
+	if d := time.Since(start); d >= d1/2 {
+		t.Errorf("Expected a clock rate of 0 (%v) to be much faster than realtime (%v)\n", d, d1)
+	}
+}
+
 func checkRegisters(e []uint16, c *DCPU16, t *testing.T, msg ...string) {
 	r := c.Registers()
 	for i, v := range r {
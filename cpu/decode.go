@@ -0,0 +1,201 @@
+package cpu
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	registerNames = []string{"A", "B", "C", "X", "Y", "Z", "I", "J"}
+	basicNames    = map[uint16]string{
+		SET: "SET", ADD: "ADD", SUB: "SUB", MUL: "MUL", MLI: "MLI", DIV: "DIV",
+		DVI: "DVI", MOD: "MOD", MDI: "MDI", AND: "AND", BOR: "BOR", XOR: "XOR",
+		SHR: "SHR", ASR: "ASR", SHL: "SHL", IFB: "IFB", IFC: "IFC", IFE: "IFE",
+		IFN: "IFN", IFG: "IFG", IFA: "IFA", IFL: "IFL", IFU: "IFU", ADX: "ADX",
+		SBX: "SBX", STI: "STI", STD: "STD",
+	}
+	extNames = map[uint16]string{
+		JSR: "JSR", INT: "INT", IAG: "IAG", IAS: "IAS", RFI: "RFI", IAQ: "IAQ",
+		HWN: "HWN", HWQ: "HWQ", HWI: "HWI",
+	}
+)
+
+// Instruction is a single decoded instruction.
+type Instruction struct {
+	Addr     uint16   // address of the instruction's first word
+	Length   uint16   // number of words, including operand words
+	Mnemonic string   // e.g. "SET", "JSR" or "DAT" for undecodable words
+	Operands []string // b then a for basic opcodes, a for extended opcodes
+}
+
+// String returns the instruction in assembler syntax (e.g. "SET A, PICK 3").
+func (in Instruction) String() string {
+	if len(in.Operands) == 0 {
+		return in.Mnemonic
+	}
+	return in.Mnemonic + " " + strings.Join(in.Operands, ", ")
+}
+
+// Decode decodes the instruction starting at m[addr]. Words that do not
+// form a valid instruction are returned as a single word DAT. If the
+// instruction's operand words extend past the end of m, the partially
+// decoded instruction is returned along with io.ErrUnexpectedEOF.
+func Decode(m []uint16, addr uint16) (Instruction, error) {
+	if int(addr) >= len(m) {
+		return Instruction{}, io.EOF
+	}
+	i := int(addr) + 1
+	return DecodeWord(addr, m[addr], func() (uint16, error) {
+		if i >= len(m) {
+			return 0, io.EOF
+		}
+		i++
+		return m[i-1], nil
+	}, nil)
+}
+
+// DecodeWord decodes the instruction at address addr whose first word is
+// word, calling next to read each of its operand words in turn. If next
+// fails, the partially decoded instruction is returned along with the error,
+// with io.EOF converted to io.ErrUnexpectedEOF.
+//
+// If symbols is not nil, operand words that match an address in symbols are
+// written as the symbol name (e.g. "SET PC, loop") rather than in hex.
+func DecodeWord(addr, word uint16, next func() (uint16, error), symbols map[uint16]string) (Instruction, error) {
+	d := decoder{next: next, symbols: symbols}
+	in := Instruction{Addr: addr, Length: 1}
+	opcode := word & OPCODE_MASK
+	a := (word & ARGA_MASK) >> ARGA_SHIFT
+	b := (word & ARGB_MASK) >> ARGB_SHIFT
+
+	if opcode == EXT {
+		name, ok := extNames[b]
+		if !ok {
+			return dat(addr, word), nil
+		}
+		in.Mnemonic = name
+		sa, err := d.operand(a, true)
+		in.Operands = []string{sa}
+		in.Length += d.n
+		return in, err
+	}
+
+	name, ok := basicNames[opcode]
+	if !ok {
+		return dat(addr, word), nil
+	}
+	in.Mnemonic = name
+	// the a operand's next word (if any) precedes the b operand's
+	sa, err := d.operand(a, true)
+	if err != nil {
+		in.Operands = []string{"?", sa}
+		in.Length += d.n
+		return in, err
+	}
+	sb, err := d.operand(b, false)
+	in.Operands = []string{sb, sa}
+	in.Length += d.n
+	return in, err
+}
+
+// dat returns an Instruction representing v as a raw data word.
+func dat(addr, v uint16) Instruction {
+	return Instruction{
+		Addr:     addr,
+		Length:   1,
+		Mnemonic: "DAT",
+		Operands: []string{fmt.Sprintf("0x%04x", v)},
+	}
+}
+
+// decoder reads the operand words of an instruction.
+type decoder struct {
+	next    func() (uint16, error)
+	symbols map[uint16]string
+	n       uint16 // number of operand words read
+}
+
+// word reads the next operand word.
+func (d *decoder) word() (uint16, error) {
+	v, err := d.next()
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return 0, err
+	}
+	d.n++
+	return v, nil
+}
+
+// symbol returns the name of address v, or v in hex if it has none.
+func (d *decoder) symbol(v uint16) string {
+	if name, ok := d.symbols[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", v)
+}
+
+// operand formats the operand with addressing mode mode, reading its next
+// word when required. isA is true for the a operand, which distinguishes POP
+// (a) from PUSH (b).
+func (d *decoder) operand(mode uint16, isA bool) (string, error) {
+	switch {
+	case mode <= 0x07:
+		return registerNames[mode], nil
+	case mode <= 0x0f:
+		return fmt.Sprintf("[%s]", registerNames[mode-0x08]), nil
+	case mode <= 0x17:
+		v, err := d.word()
+		return fmt.Sprintf("[%s+%s]", d.symbol(v), registerNames[mode-0x10]), err
+	case mode == 0x18:
+		if isA {
+			return "POP", nil
+		}
+		return "PUSH", nil
+	case mode == 0x19:
+		return "PEEK", nil
+	case mode == 0x1a:
+		v, err := d.word()
+		return fmt.Sprintf("PICK %d", v), err
+	case mode == 0x1b:
+		return "SP", nil
+	case mode == 0x1c:
+		return "PC", nil
+	case mode == 0x1d:
+		return "EX", nil
+	case mode == 0x1e:
+		v, err := d.word()
+		return fmt.Sprintf("[%s]", d.symbol(v)), err
+	case mode == 0x1f:
+		v, err := d.word()
+		return d.symbol(v), err
+	}
+	// short literal 0x20-0x3f (-1..30)
+	return fmt.Sprintf("0x%02x", ShortLiteral(mode)), nil
+}
+
+// DisassembleNext returns the instruction at the PC in assembler syntax
+// (e.g. "SET A, 0x30") and the number of words it occupies, without
+// executing it. Words that are not a valid instruction are returned as a
+// single word DAT.
+func (c *DCPU16) DisassembleNext() (text string, length uint16) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	in := c.decodeAt(c.pc)
+	return in.String(), in.Length
+}
+
+// decodeAt decodes the instruction at addr in the CPU's memory. The CPU must
+// be locked.
+func (c *DCPU16) decodeAt(addr uint16) Instruction {
+	// operand words wrap around the end of memory, as they do when executed
+	next := addr + 1
+	in, _ := DecodeWord(addr, c.memory[addr], func() (uint16, error) {
+		next++
+		return c.memory[next-1], nil
+	}, nil)
+	return in
+}
@@ -0,0 +1,90 @@
+package cpu
+
+import (
+	"testing"
+)
+
+func TestDisassembleNext(t *testing.T) {
+	c := NewDCPU16()
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x1f), 0x0030, // SET A, 0x30
+		makeOpcode(SET, 0x1e, 0x1f), 0x0020, 0x1000, // SET [0x1000], 0x20
+		makeOpcode(EXT, JSR, 0x1a), 0x0002, // JSR PICK 2
+		makeOpcode(ADD, PUSH, 0x2a), // ADD PUSH, 9
+		0x0018,                      // undefined opcode
+	})
+	tests := []struct {
+		text   string
+		length uint16
+	}{
+		{"SET A, 0x30", 2},
+		{"SET [0x1000], 0x20", 3},
+		{"JSR PICK 2", 2},
+		{"ADD PUSH, 0x09", 1},
+		{"DAT 0x0018", 1},
+	}
+
+	for _, test := range tests {
+		pc := c.Registers()[PC]
+		text, length := c.DisassembleNext()
+		if text != test.text || length != test.length {
+			t.Errorf("0x%04x: expected %q (%d), got %q (%d)\n", pc, test.text, test.length, text, length)
+		}
+		if r := c.Registers(); r[PC] != pc || r[TICK] != 0 {
+			t.Errorf("Expected DisassembleNext not to change PC or TICK, got %v\n", r)
+		}
+		c.SetRegister("PC", pc+length)
+	}
+}
+
+func TestInstructionLength(t *testing.T) {
+	tests := []struct {
+		word   uint16
+		length int
+	}{
+		{makeOpcode(SET, A, B), 1},       // SET A, B
+		{makeOpcode(SET, PUSH, 0x3f), 1}, // SET PUSH, 30
+		{makeOpcode(SET, A, 0x1f), 2},    // SET A, next
+		{makeOpcode(SET, 0x1e, A), 2},    // SET [next], A
+		{makeOpcode(ADD, A, 0x10), 2},    // ADD A, [next+A]
+		{makeOpcode(SET, B, 0x1a), 2},    // SET B, PICK n
+		{makeOpcode(SET, 0x17, 0x1f), 3}, // SET [next+J], next
+		{makeOpcode(IFE, 0x1a, 0x1e), 3}, // IFE PICK n, [next]
+		{makeOpcode(EXT, JSR, 0x1f), 2},  // JSR next
+		{makeOpcode(EXT, HWI, 0x21), 1},  // HWI 0; b field is the opcode
+		{makeOpcode(EXT, IAQ, A), 1},     // IAQ A
+	}
+
+	for _, test := range tests {
+		m := []uint16{0, test.word}
+		if n := InstructionLength(m, 1); n != test.length {
+			t.Errorf("0x%04x: expected length %d, got %d\n", test.word, test.length, n)
+		}
+	}
+	if n := InstructionLength(nil, 0); n != 0 {
+		t.Errorf("Expected length 0 outside memory, got %d\n", n)
+	}
+}
+
+func TestDisassembleNextWraps(t *testing.T) {
+	c := NewDCPU16()
+	c.Write(LASTADDR, []uint16{makeOpcode(SET, A, 0x1f)}) // SET A, next
+	c.Write(0, []uint16{0x0030})
+	c.SetRegister("PC", LASTADDR)
+	if text, length := c.DisassembleNext(); text != "SET A, 0x30" || length != 2 {
+		t.Errorf("Expected \"SET A, 0x30\" (2), got %q (%d)\n", text, length)
+	}
+}
+
+func TestDecodeSymbols(t *testing.T) {
+	m := []uint16{makeOpcode(SET, 0x10+I, 0x1f), 0x0003, 0x1000} // SET [data+I], loop
+	symbols := map[uint16]string{3: "loop", 0x1000: "data"}
+	i := 1
+	in, err := DecodeWord(0, m[0], func() (uint16, error) {
+		i++
+		return m[i-1], nil
+	}, symbols)
+	if err != nil || in.String() != "SET [data+I], loop" || in.Length != 3 {
+		t.Errorf("Expected \"SET [data+I], loop\" (3), got %q (%d): %v\n", in, in.Length, err)
+	}
+}
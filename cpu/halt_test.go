@@ -0,0 +1,138 @@
+package cpu_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/markcol/dcpu16/asm"
+	"github.com/markcol/dcpu16/cpu"
+)
+
+const sample = `
+; Try some basic stuff
+              SET A, 0x30
+              SET [0x1000], 0x20
+              SUB A, [0x1000]
+              IFN A, 0x10
+              SET PC, crash
+
+; Do a loopy thing
+              SET I, 10
+              SET A, 0x2000
+:loop         SET [0x2000+I], [A]
+              SUB I, 1
+              IFN I, 0
+              SET PC, loop
+
+; Call a subroutine
+              SET X, 0x4
+              JSR testsub
+              SET PC, crash
+
+:testsub      SHL X, 4
+              SET PC, POP
+
+; Hang forever. X should now be 0x40 if everything went right.
+:crash        SET PC, crash
+`
+
+// memoryWriter writes assembled words into the memory of a CPU.
+type memoryWriter struct {
+	c    *cpu.DCPU16
+	addr uint16
+}
+
+func (w *memoryWriter) WriteWord(v uint16) error {
+	w.c.Write(w.addr, []uint16{v})
+	w.addr++
+	return nil
+}
+
+func TestHalted(t *testing.T) {
+	c := cpu.NewDCPU16()
+	c.SetClockRate(0)
+	if err := asm.Assemble(strings.NewReader(sample), &memoryWriter{c: c}); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	c.Run()
+	if !c.Halted() {
+		t.Errorf("Expected the CPU to halt\n")
+	}
+	if x, _ := c.GetRegister("X"); x != 0x40 {
+		t.Errorf("Expected X to be 0x40, got 0x%04x\n", x)
+	}
+	if pc, _ := c.GetRegister("PC"); pc != 0x1a {
+		t.Errorf("Expected to halt at crash (0x001a), got 0x%04x\n", pc)
+	}
+}
+
+func TestNotHaltedWithInterrupts(t *testing.T) {
+	c := cpu.NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, []uint16{
+		0x7d40, 0x0100, // IAS 0x100
+		0x8f81, // :spin SET PC, spin
+	})
+	c.StepN(2)
+	if pc, _ := c.GetRegister("PC"); pc != 2 || c.Halted() {
+		t.Errorf("Expected a self jump with interrupts enabled not to halt\n")
+	}
+}
+
+func TestStepNHalts(t *testing.T) {
+	c := cpu.NewDCPU16()
+	c.SetClockRate(0)
+	if err := asm.Assemble(strings.NewReader(sample), &memoryWriter{c: c}); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if n := c.StepN(1000); n >= 1000 {
+		t.Errorf("Expected StepN to stop when the CPU halts, executed %d\n", n)
+	}
+	if !c.Halted() {
+		t.Errorf("Expected the CPU to halt\n")
+	}
+	if x, _ := c.GetRegister("X"); x != 0x40 {
+		t.Errorf("Expected X to be 0x40, got 0x%04x\n", x)
+	}
+	if pc, _ := c.GetRegister("PC"); pc != 0x1a {
+		t.Errorf("Expected to halt at crash (0x001a), got 0x%04x\n", pc)
+	}
+}
+
+func TestHaltedInLoop(t *testing.T) {
+	c := cpu.NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, []uint16{
+		0x8801,         // SET A, 1
+		0x7f81, 0x0003, // :a SET PC, b
+		0x7f81, 0x0001, // :b SET PC, a
+	})
+
+	if n := c.StepN(100); n >= 100 {
+		t.Errorf("Expected StepN to stop when the loop is detected, executed %d\n", n)
+	}
+	if pc, ok := c.HaltedAt(); !ok || pc != 1 {
+		t.Errorf("Expected the CPU to halt in the loop entered at 0x0001, got 0x%04x (%v)\n", pc, ok)
+	}
+
+	// the loop is left when the host changes memory
+	c.Write(3, []uint16{0x7f81, 0x0005}) // :b SET PC, end
+	c.StepN(1)
+	if c.Halted() {
+		t.Errorf("Expected the CPU not to be halted after memory was changed\n")
+	}
+}
+
+func TestNotHaltedWhenChangingMemory(t *testing.T) {
+	c := cpu.NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, []uint16{
+		0x8bc2, 0x1000, // :loop ADD [0x1000], 1
+		0x7f81, 0x0000, // SET PC, loop
+	})
+	if n := c.StepN(100); n != 100 || c.Halted() {
+		t.Errorf("Expected a loop that changes memory not to halt, executed %d\n", n)
+	}
+}
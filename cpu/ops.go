@@ -0,0 +1,267 @@
+package cpu
+
+// basicOps is the dispatch table for the basic instructions, indexed by
+// opcode. Each function executes the instruction with operands a and b,
+// adding any cycles beyond the first to c.tick, and reports whether it stored
+// a result in b. Undefined opcodes are nil.
+var basicOps = [OPCODE_MASK + 1]func(c *DCPU16, a, b *uint16) bool{
+	SET: opSET, ADD: opADD, SUB: opSUB, MUL: opMUL, MLI: opMLI, DIV: opDIV,
+	DVI: opDVI, MOD: opMOD, MDI: opMDI, AND: opAND, BOR: opBOR, XOR: opXOR,
+	SHR: opSHR, ASR: opASR, SHL: opSHL, IFB: opIFB, IFC: opIFC, IFE: opIFE,
+	IFN: opIFN, IFG: opIFG, IFA: opIFA, IFL: opIFL, IFU: opIFU, ADX: opADX,
+	SBX: opSBX, STI: opSTI, STD: opSTD,
+}
+
+// sets B to A
+func opSET(c *DCPU16, a, b *uint16) bool {
+	*b = *a
+	return true
+}
+
+// sets B to B+A, sets EX if there's an overflow, 0x0 otherwise
+func opADD(c *DCPU16, a, b *uint16) bool {
+	v := uint32(*b) + uint32(*a)
+	c.ex = uint16(v >> 16)
+	*b = uint16(v)
+	c.tick++
+	return true
+}
+
+// sets B to B-A, sets EX if there's an underflow, 0x0 otherwise
+func opSUB(c *DCPU16, a, b *uint16) bool {
+	v := int32(*b) - int32(*a)
+	c.ex = uint16(v >> 16)
+	*b = uint16(v)
+	c.tick++
+	return true
+}
+
+// sets B to B*A, sets EX to ((B*A)>>16)&0xffff (treats A, B as unsigned)
+func opMUL(c *DCPU16, a, b *uint16) bool {
+	v := int32(uint32(*b) * uint32(*a))
+	c.ex = uint16(v >> 16)
+	*b = uint16(v)
+	c.tick++
+	return true
+}
+
+// like MUL, but treats A, B as signed
+func opMLI(c *DCPU16, a, b *uint16) bool {
+	v := int32(int16(*b)) * int32(int16(*a))
+	c.ex = uint16(v >> 16)
+	*b = uint16(v)
+	c.tick++
+	return true
+}
+
+// sets B to B/A, sets EX to ((B<<16)/A)&0xffff. if A==0, sets B and EX to 0
+// instead.
+func opDIV(c *DCPU16, a, b *uint16) bool {
+	if *a == 0 && c.trapDivZero {
+		c.fault("division by zero")
+		c.tick += 2
+		return false
+	}
+	if *a == 0 {
+		*b = 0
+		c.ex = 0
+	} else {
+		c.ex = uint16((uint32(*b) << 16) / uint32(*a))
+		*b /= *a
+	}
+	c.tick += 2
+	return true
+}
+
+// like DIV, but treats A, B as signed, rounding towards 0
+func opDVI(c *DCPU16, a, b *uint16) bool {
+	if *a == 0 && c.trapDivZero {
+		c.fault("division by zero")
+		c.tick += 2
+		return false
+	}
+	if *a == 0 {
+		*b = 0
+		c.ex = 0
+	} else {
+		c.ex = uint16((int32(int16(*b)) << 16) / int32(int16(*a)))
+		*b = uint16(int16(*b) / int16(*a))
+	}
+	c.tick += 2
+	return true
+}
+
+// sets B to B%A. if A==0, sets B to 0 instead.
+func opMOD(c *DCPU16, a, b *uint16) bool {
+	if *a == 0 && c.trapDivZero {
+		c.fault("division by zero")
+		c.tick += 2
+		return false
+	}
+	if *a == 0 {
+		*b = 0
+	} else {
+		*b %= *a
+	}
+	c.tick += 2
+	return true
+}
+
+// like MOD, but signed; the result has the sign of B (e.g., -7 MDI 16 == -7)
+func opMDI(c *DCPU16, a, b *uint16) bool {
+	if *a == 0 && c.trapDivZero {
+		c.fault("division by zero")
+		c.tick += 2
+		return false
+	}
+	if *a == 0 {
+		*b = 0
+	} else {
+		*b = uint16(int16(*b) % int16(*a))
+	}
+	c.tick += 2
+	return true
+}
+
+// sets B to B&A
+func opAND(c *DCPU16, a, b *uint16) bool {
+	*b &= *a
+	return true
+}
+
+// sets B to B|A
+func opBOR(c *DCPU16, a, b *uint16) bool {
+	*b |= *a
+	return true
+}
+
+// sets B to B^A
+func opXOR(c *DCPU16, a, b *uint16) bool {
+	*b ^= *a
+	return true
+}
+
+// Shifts by 16 or more move every bit of B out of the result, and shifts by 32
+// or more move them out of EX as well, leaving only sign bits for ASR. Go
+// shifts of at least the operand width give exactly those results, so the
+// shift amount is deliberately not masked.
+
+// sets B to B>>A, sets EX to ((B<<16)>>A)&0xffff
+func opSHR(c *DCPU16, a, b *uint16) bool {
+	c.ex = uint16(((uint32(*b) << 16) >> *a))
+	*b >>= *a
+	return true
+}
+
+// sets B to B>>A, sets EX to ((B<<16)>>>A)&0xffff (treats b as signed)
+func opASR(c *DCPU16, a, b *uint16) bool {
+	c.ex = uint16(((int32(*b) << 16) >> *a))
+	t := int16(*b)
+	t >>= *a
+	*b = uint16(t)
+	return true
+}
+
+// sets B to B<<A, sets EX to ((B<<A)>>16)&0xffff
+func opSHL(c *DCPU16, a, b *uint16) bool {
+	c.ex = uint16(((uint32(*b) << *a) >> 16))
+	*b <<= *a
+	return true
+}
+
+// performs next instruction only if (B&A)!=0
+func opIFB(c *DCPU16, a, b *uint16) bool {
+	return c.conditional((*b & *a) != 0)
+}
+
+// performs next instruction only if (B&A)==0
+func opIFC(c *DCPU16, a, b *uint16) bool {
+	return c.conditional((*b & *a) == 0)
+}
+
+// performs next instruction only if B==A
+func opIFE(c *DCPU16, a, b *uint16) bool {
+	return c.conditional(*b == *a)
+}
+
+// performs next instruction only if B!=A
+func opIFN(c *DCPU16, a, b *uint16) bool {
+	return c.conditional(*b != *a)
+}
+
+// performs next instruction only if B > A
+func opIFG(c *DCPU16, a, b *uint16) bool {
+	return c.conditional(*b > *a)
+}
+
+// performs next instruction only if B > A (signed)
+func opIFA(c *DCPU16, a, b *uint16) bool {
+	return c.conditional(int16(*b) > int16(*a))
+}
+
+// performs next instruction only if B < A
+func opIFL(c *DCPU16, a, b *uint16) bool {
+	return c.conditional(*b < *a)
+}
+
+// performs next instruction only if B < A (signed)
+func opIFU(c *DCPU16, a, b *uint16) bool {
+	return c.conditional(int16(*b) < int16(*a))
+}
+
+// sets B to B+A+EX, sets EX to 0x0001 if there is an overflow
+func opADX(c *DCPU16, a, b *uint16) bool {
+	v := uint32(*b) + uint32(*a) + uint32(c.ex)
+	if v > 0xffff {
+		c.ex = 0x0001
+	} else {
+		c.ex = 0
+	}
+	*b = uint16(v)
+	c.tick += 2
+	return true
+}
+
+// sets B to B-A+EX, sets EX to 0xffff on underflow, 0x0001 on overflow
+func opSBX(c *DCPU16, a, b *uint16) bool {
+	// EX holds the borrow (0xffff) of a previous SUB or SBX
+	v := int32(*b) - int32(*a) + int32(int16(c.ex))
+	if v < 0 {
+		c.ex = 0xffff
+	} else if v > 0xffff {
+		c.ex = 0x0001
+	} else {
+		c.ex = 0
+	}
+	*b = uint16(v)
+	c.tick += 2
+	return true
+}
+
+// sets B to A, then increases I and J by 1
+func opSTI(c *DCPU16, a, b *uint16) bool {
+	*b = *a
+	c.register[I]++
+	c.register[J]++
+	c.tick++
+	return true
+}
+
+// sets B to A, then decreases I and J by 1
+func opSTD(c *DCPU16, a, b *uint16) bool {
+	*b = *a
+	c.register[I]--
+	c.register[J]--
+	c.tick++
+	return true
+}
+
+// conditional completes an IFx instruction, skipping the next instruction
+// unless ok. It returns false, since a conditional stores no result.
+func (c *DCPU16) conditional(ok bool) bool {
+	if !ok {
+		c.skipConditional()
+	}
+	c.tick++
+	return false
+}
@@ -0,0 +1,68 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// LoadProgram reads big-endian words from r into memory starting at addr,
+// until r returns io.EOF or the end of memory is reached. It returns the
+// number of words loaded. A trailing odd byte returns io.ErrUnexpectedEOF.
+func (c *DCPU16) LoadProgram(addr uint16, r io.Reader) (n int, err error) {
+	return c.LoadProgramOrder(addr, r, binary.BigEndian)
+}
+
+// LoadProgramBE is the same as LoadProgram.
+func (c *DCPU16) LoadProgramBE(addr uint16, r io.Reader) (int, error) {
+	return c.LoadProgramOrder(addr, r, binary.BigEndian)
+}
+
+// LoadProgramLE is like LoadProgram, but reads little-endian words.
+func (c *DCPU16) LoadProgramLE(addr uint16, r io.Reader) (int, error) {
+	return c.LoadProgramOrder(addr, r, binary.LittleEndian)
+}
+
+// LoadProgramOrder is like LoadProgram, but reads words in the byte order
+// given by order.
+func (c *DCPU16) LoadProgramOrder(addr uint16, r io.Reader, order binary.ByteOrder) (n int, err error) {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.forgetLoop()
+	var b [2]byte
+	for i := int(addr); i < RAMSIZE; i++ {
+		if _, err := io.ReadFull(r, b[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		c.memory[i] = order.Uint16(b[:])
+		n++
+	}
+	return n, nil
+}
+
+// DumpMemory writes length words of memory starting at addr to w as
+// big-endian bytes. Fewer words are written if addr + length exceeds
+// addressable memory. An error is returned if length is negative.
+func (c *DCPU16) DumpMemory(addr uint16, length int, w io.Writer) error {
+	if length < 0 {
+		return fmt.Errorf("negative length %d", length)
+	}
+
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if int(addr)+length > LASTADDR {
+		length = LASTADDR - int(addr) + 1
+	}
+	b := make([]byte, 2*length)
+	for i := 0; i < length; i++ {
+		binary.BigEndian.PutUint16(b[2*i:], c.memory[int(addr)+i])
+	}
+	_, err := w.Write(b)
+	return err
+}
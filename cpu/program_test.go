@@ -0,0 +1,91 @@
+package cpu
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestLoadProgram(t *testing.T) {
+	c := NewDCPU16()
+	data := []byte{0x7c, 0x01, 0x00, 0x30, 0x7f, 0xc1}
+
+	n, err := c.LoadProgram(0x10, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 words to be loaded, got %d\n", n)
+	}
+	e := []uint16{0x7c01, 0x0030, 0x7fc1, 0x0000}
+	for i, v := range c.Read(0x10, 4) {
+		if v != e[i] {
+			t.Errorf("0x%04x: expected 0x%04x, got 0x%04x\n", 0x10+i, e[i], v)
+		}
+	}
+
+	// loading stops at the end of memory
+	if n, err := c.LoadProgram(LASTADDR, bytes.NewReader(data)); err != nil || n != 1 {
+		t.Errorf("Expected 1 word to be loaded, got %d (%v)\n", n, err)
+	}
+
+	// an odd number of bytes
+	if _, err := c.LoadProgram(0, bytes.NewReader(data[:3])); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v\n", err)
+	}
+}
+
+func TestLoadProgramOrder(t *testing.T) {
+	data := []byte{0x7c, 0x01, 0x00, 0x30}
+
+	be := NewDCPU16()
+	if _, err := be.LoadProgramBE(0, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	le := NewDCPU16()
+	if _, err := le.LoadProgramLE(0, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	for i, e := range []uint16{0x7c01, 0x0030} {
+		if v := be.Read(uint16(i), 1)[0]; v != e {
+			t.Errorf("big-endian 0x%04x: expected 0x%04x, got 0x%04x\n", i, e, v)
+		}
+		if v, e := le.Read(uint16(i), 1)[0], e>>8|e<<8; v != e {
+			t.Errorf("little-endian 0x%04x: expected 0x%04x, got 0x%04x\n", i, e, v)
+		}
+	}
+}
+
+func TestDumpMemory(t *testing.T) {
+	c := NewDCPU16()
+	data := []byte{0x7c, 0x01, 0x00, 0x30, 0x7f, 0xc1}
+	if _, err := c.LoadProgram(0x10, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	b := new(bytes.Buffer)
+	if err := c.DumpMemory(0x10, 3, b); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Errorf("Expected % x, got % x\n", data, b.Bytes())
+	}
+
+	// dumps are clamped at the end of memory
+	b.Reset()
+	if err := c.DumpMemory(LASTADDR, 3, b); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if b.Len() != 2 {
+		t.Errorf("Expected 2 bytes, got %d\n", b.Len())
+	}
+
+	b.Reset()
+	if err := c.DumpMemory(0x10, -1, b); err == nil {
+		t.Errorf("Expected an error for a negative length\n")
+	}
+	if b.Len() != 0 {
+		t.Errorf("Expected nothing to be written, got %d bytes\n", b.Len())
+	}
+}
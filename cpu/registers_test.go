@@ -0,0 +1,26 @@
+package cpu_test
+
+import (
+	"testing"
+
+	"github.com/markcol/dcpu16/cpu"
+)
+
+func TestExportedRegisters(t *testing.T) {
+	c := cpu.NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, []uint16{
+		0x7c01, 0x0030, // SET A, 0x30
+		0x7f61, 0x1000, // SET SP, 0x1000
+	})
+	c.Step()
+	c.Step()
+
+	r := c.Registers()
+	if r[cpu.A] != 0x30 || r[cpu.SP] != 0x1000 || r[cpu.PC] != 4 || r[cpu.TICK] != 4 {
+		t.Errorf("Expected A=0x30, SP=0x1000, PC=4, TICK=4, got %v\n", r)
+	}
+	if r[cpu.EX] != 0 || r[cpu.IA] != 0 || r[cpu.IQ] != 0 {
+		t.Errorf("Expected EX, IA and IQ to be 0, got %v\n", r)
+	}
+}
@@ -0,0 +1,51 @@
+package cpu
+
+import (
+	"io"
+)
+
+// Serial is a memory-mapped serial console, for programs that need simple
+// character I/O without a display or keyboard. Attach it with MapDevice.
+// Each word written to its address sends its low byte to the output, and
+// each read returns the next byte of input, or 0 if there is none.
+type Serial struct {
+	r   io.Reader
+	w   io.Writer
+	err error
+}
+
+// NewSerial returns a serial console that reads input from r and writes
+// output to w. Either may be nil, in which case reads return 0 and writes
+// are discarded.
+func NewSerial(r io.Reader, w io.Writer) *Serial {
+	return &Serial{r: r, w: w}
+}
+
+// WriteWord writes the low byte of val to the output.
+func (s *Serial) WriteWord(addr, val uint16) {
+	if s.w == nil || s.err != nil {
+		return
+	}
+	_, s.err = s.w.Write([]byte{byte(val)})
+}
+
+// ReadWord returns the next byte of input, or 0 if the input is exhausted.
+func (s *Serial) ReadWord(addr uint16) uint16 {
+	if s.r == nil {
+		return 0
+	}
+	var b [1]byte
+	if n, err := s.r.Read(b[:]); n == 0 {
+		if err != nil && err != io.EOF && s.err == nil {
+			s.err = err
+		}
+		return 0
+	}
+	return uint16(b[0])
+}
+
+// Err returns the first error other than io.EOF returned by the input or
+// output, after which output is discarded.
+func (s *Serial) Err() error {
+	return s.err
+}
@@ -0,0 +1,43 @@
+package cpu
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSerialOutput(t *testing.T) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	out := new(bytes.Buffer)
+	c.MapDevice(0x9000, 0x9000, NewSerial(nil, out))
+	c.Write(0, []uint16{
+		makeOpcode(SET, 0x1e, 0x1f), 'H', 0x9000, // SET [0x9000], 'H'
+		makeOpcode(SET, 0x1e, 0x1f), 'i', 0x9000, // SET [0x9000], 'i'
+		makeOpcode(SET, 0x1e, 0x1f), '!', 0x9000, // SET [0x9000], '!'
+	})
+	c.StepN(3)
+	if out.String() != "Hi!" {
+		t.Errorf("Expected %q, got %q\n", "Hi!", out)
+	}
+}
+
+func TestSerialInput(t *testing.T) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	s := NewSerial(strings.NewReader("ok"), nil)
+	c.MapDevice(0x9000, 0x9000, s)
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x1e), 0x9000, // SET A, [0x9000]
+		makeOpcode(SET, B, 0x1e), 0x9000, // SET B, [0x9000]
+		makeOpcode(SET, C, 0x1e), 0x9000, // SET C, [0x9000]
+	})
+	c.StepN(3)
+	r := c.Registers()
+	if r[A] != 'o' || r[B] != 'k' || r[C] != 0 {
+		t.Errorf("Expected A='o', B='k', C=0, got: %v\n", r)
+	}
+	if s.Err() != nil {
+		t.Errorf("Unexpected error: %v\n", s.Err())
+	}
+}
@@ -0,0 +1,159 @@
+package cpu
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// State is a copy of the complete state of a CPU, as returned by Snapshot.
+type State struct {
+	Name        string // name of the CPU, if set with SetName; not restored
+	Registers   [8]uint16
+	PC          uint16
+	SP          uint16
+	EX          uint16
+	IA          uint16
+	Tick        uint16
+	IntQueue    []uint16
+	IntQueueing bool
+	Memory      []uint16 // RAMSIZE words
+}
+
+// Snapshot returns a copy of the registers, interrupt state and memory of
+// the CPU.
+func (c *DCPU16) Snapshot() *State {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s := &State{
+		Name:        c.name,
+		Registers:   c.register,
+		PC:          c.pc,
+		SP:          c.sp,
+		EX:          c.ex,
+		IA:          c.ia,
+		Tick:        c.tick,
+		IntQueueing: c.intQueueing,
+		Memory:      make([]uint16, RAMSIZE),
+	}
+	c.intMutex.Lock()
+	s.IntQueue = append([]uint16{}, c.intQueue...)
+	c.intMutex.Unlock()
+	copy(s.Memory, c.memory[:])
+	return s
+}
+
+// Clone returns an independent copy of the CPU, including its registers,
+// memory, interrupt queue, breakpoints, watchpoints and settings. Attached
+// hardware is not cloned: the copy shares the same Device values, so devices
+// that keep state or a reference to the CPU must be replaced on the copy if
+// it is to run separately.
+func (c *DCPU16) Clone() *DCPU16 {
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	n := &DCPU16{
+		register:    c.register,
+		memory:      c.memory,
+		pc:          c.pc,
+		sp:          c.sp,
+		ex:          c.ex,
+		ia:          c.ia,
+		tick:        c.tick,
+		cycles:      c.cycles,
+		intQueueing: c.intQueueing,
+		period:      c.period,
+		unlimited:   c.unlimited,
+		unthrottled: c.unthrottled,
+		epoch:       c.epoch,
+		simulated:   c.simulated,
+		skew:        c.skew,
+		faultFunc:   c.faultFunc,
+		traceFunc:   c.traceFunc,
+		traceWriter: c.traceWriter,
+		trapPCWrap:  c.trapPCWrap,
+		trapDivZero: c.trapDivZero,
+		name:        c.name,
+		debugInfo:   c.debugInfo,
+		hardware:    append([]Device(nil), c.hardware...),
+		caughtFire:  c.caughtFire,
+		halted:      c.halted,
+		haltPC:      c.haltPC,
+		changed:     c.changed,
+		loop:        c.loop,
+		loopLen:     c.loopLen,
+		loopNext:    c.loopNext,
+		leaAddr:     -1,
+		mappings:    append([]mapping(nil), c.mappings...),
+		last:        c.last,
+	}
+	c.intMutex.Lock()
+	n.intQueue = append([]uint16(nil), c.intQueue...)
+	n.overflowFunc = c.overflowFunc
+	c.intMutex.Unlock()
+	if c.breakpoints != nil {
+		n.breakpoints = make(map[uint16]bool, len(c.breakpoints))
+		for addr, v := range c.breakpoints {
+			n.breakpoints[addr] = v
+		}
+	}
+	if c.watchpoints != nil {
+		n.watchpoints = make(map[uint16]WatchKind, len(c.watchpoints))
+		for addr, kind := range c.watchpoints {
+			n.watchpoints[addr] = kind
+		}
+	}
+	return n
+}
+
+// Restore replaces the registers, interrupt state and memory of the CPU with
+// those in s, and puts out any fire or halt so that execution can resume
+// from the snapshot. An error is returned, and the CPU left unchanged, if s
+// does not hold exactly RAMSIZE words of memory or has more than MAX_INTQUEUE
+// queued interrupts.
+func (c *DCPU16) Restore(s *State) error {
+	if len(s.Memory) != RAMSIZE {
+		return fmt.Errorf("state has %d words of memory, want %d", len(s.Memory), RAMSIZE)
+	}
+	if len(s.IntQueue) > MAX_INTQUEUE {
+		return fmt.Errorf("state has %d queued interrupts, max %d", len(s.IntQueue), MAX_INTQUEUE)
+	}
+
+	// wait for an instruction boundary
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.register = s.Registers
+	c.pc = s.PC
+	c.sp = s.SP
+	c.ex = s.EX
+	c.ia = s.IA
+	c.tick = s.Tick
+	c.intMutex.Lock()
+	c.intQueue = append(c.intQueue[:0], s.IntQueue...)
+	c.intMutex.Unlock()
+	c.intQueueing = s.IntQueueing
+	copy(c.memory[:], s.Memory)
+	c.caughtFire = false
+	c.halted = false
+	c.forgetLoop()
+	return nil
+}
+
+// SaveState writes a snapshot of the CPU to w in gob format.
+func (c *DCPU16) SaveState(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(c.Snapshot())
+}
+
+// LoadState restores the CPU from a snapshot read from r, as written by
+// SaveState.
+func (c *DCPU16) LoadState(r io.Reader) error {
+	var s State
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	return c.Restore(&s)
+}
@@ -0,0 +1,214 @@
+package cpu
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := NewDCPU16()
+	c.period = time.Nanosecond
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x1f), 0x1234, // SET A, 0x1234
+		makeOpcode(SET, PUSH, A),   // SET PUSH, A
+		makeOpcode(EXT, IAQ, 0x22), // IAQ 1
+		makeOpcode(EXT, INT, 0x25), // INT 4
+	})
+	for i := 0; i < 4; i++ {
+		c.Step()
+	}
+
+	s := c.Snapshot()
+	r := c.Registers()
+	got := append(s.Registers[:], s.PC, s.SP, s.EX, s.IA, s.Tick)
+	for i, v := range got {
+		if v != r[i] {
+			t.Errorf("register %d: expected 0x%04x, got 0x%04x\n", i, r[i], v)
+		}
+	}
+	if !s.IntQueueing || len(s.IntQueue) != 1 || s.IntQueue[0] != 4 {
+		t.Errorf("Expected queued interrupt [4], got %v (queueing %v)\n", s.IntQueue, s.IntQueueing)
+	}
+	if len(s.Memory) != RAMSIZE || s.Memory[1] != 0x1234 || s.Memory[LASTADDR] != 0x1234 {
+		t.Errorf("Expected a copy of memory\n")
+	}
+
+	// the snapshot is a copy
+	s.Memory[1] = 0
+	if c.Read(1, 1)[0] != 0x1234 {
+		t.Errorf("Expected modifying the snapshot to leave memory unchanged\n")
+	}
+}
+
+func TestClone(t *testing.T) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x1f), 0x1234, // SET A, 0x1234
+		makeOpcode(EXT, IAQ, 0x22), // IAQ 1
+		makeOpcode(EXT, INT, 0x25), // INT 4
+		makeOpcode(ADD, A, 0x22),   // ADD A, 1
+	})
+	c.SetBreakpoint(5)
+	c.StepN(3)
+
+	n := c.Clone()
+	e := n.Registers()
+	if r := c.Registers(); !reflect.DeepEqual(r, e) {
+		t.Errorf("Expected registers %v, got %v\n", r, e)
+	}
+
+	// changes to the original leave the clone unchanged
+	c.Step()
+	c.Write(0, []uint16{0xffff})
+	c.TriggerInterrupt(5)
+	c.ClearBreakpoint(5)
+	checkRegisters(e, n, t, "clone")
+	if v := n.Read(0, 1)[0]; v != makeOpcode(SET, A, 0x1f) {
+		t.Errorf("Expected clone memory to be unchanged, got 0x%04x\n", v)
+	}
+	if s := n.Snapshot(); len(s.IntQueue) != 1 || s.IntQueue[0] != 4 {
+		t.Errorf("Expected clone interrupt queue [4], got %v\n", s.IntQueue)
+	}
+	if !n.breakpoints[5] {
+		t.Errorf("Expected clone to keep its breakpoint\n")
+	}
+}
+
+func TestCloneHalted(t *testing.T) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x22),       // SET A, 1
+		makeOpcode(SET, 0x1c, 0x1f), 3, // :a SET PC, b
+		makeOpcode(SET, 0x1c, 0x1f), 1, // :b SET PC, a
+	})
+	c.StepN(100)
+	pc, ok := c.HaltedAt()
+	if !ok {
+		t.Fatalf("Expected the CPU to halt\n")
+	}
+
+	n := c.Clone()
+	if npc, nok := n.HaltedAt(); npc != pc || nok != ok {
+		t.Errorf("Expected the clone to be halted at 0x%04x, got 0x%04x (%v)\n", pc, npc, nok)
+	}
+
+	// the clone continues loop detection from the same history
+	c.Step()
+	n.Step()
+	pc, ok = c.HaltedAt()
+	if npc, nok := n.HaltedAt(); npc != pc || nok != ok {
+		t.Errorf("Expected the clone to be halted at 0x%04x (%v), got 0x%04x (%v)\n", pc, ok, npc, nok)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	c := NewDCPU16()
+	c.period = time.Nanosecond
+	c.Write(0, []uint16{
+		makeOpcode(ADD, A, 0x22),    // ADD A, 1
+		makeOpcode(SET, PUSH, A),    // SET PUSH, A
+		makeOpcode(SET, 0x1c, 0x21), // SET PC, 0
+	})
+	for i := 0; i < 3; i++ {
+		c.Step()
+	}
+	s := c.Snapshot()
+	r := c.Registers()
+	m := c.Read(LASTADDR, 1)[0]
+
+	for i := 0; i < 5; i++ {
+		c.Step()
+	}
+	if err := c.Restore(s); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	checkRegisters(r, c, t, "Restore")
+	if v := c.Read(LASTADDR, 1)[0]; v != m {
+		t.Errorf("Expected 0x%04x at 0x%04x, got 0x%04x\n", m, LASTADDR, v)
+	}
+
+	bad := *s
+	bad.Memory = bad.Memory[:10]
+	if err := c.Restore(&bad); err == nil {
+		t.Errorf("Expected an error restoring short memory\n")
+	}
+	bad = *s
+	bad.IntQueue = make([]uint16, MAX_INTQUEUE+1)
+	if err := c.Restore(&bad); err == nil {
+		t.Errorf("Expected an error restoring an oversized interrupt queue\n")
+	}
+}
+
+func TestRestoreAfterFire(t *testing.T) {
+	c := NewDCPU16()
+	c.SetClockRate(0)
+	c.Write(0, []uint16{
+		makeOpcode(EXT, IAQ, 0x22),  // IAQ 1
+		makeOpcode(EXT, INT, 0x22),  // :loop INT 1
+		makeOpcode(SET, 0x1c, 0x22), // SET PC, loop
+	})
+	s := c.Snapshot()
+	b := new(bytes.Buffer)
+	if err := c.SaveState(b); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	c.StepN(1 + 2*(MAX_INTQUEUE+1))
+	if !c.CaughtFire() {
+		t.Fatalf("Expected the CPU to have caught fire\n")
+	}
+	if err := c.Restore(s); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if c.CaughtFire() || c.StepN(3) != 3 {
+		t.Errorf("Expected Restore to put out the fire\n")
+	}
+
+	c.StepN(2 * MAX_INTQUEUE)
+	if !c.CaughtFire() {
+		t.Fatalf("Expected the CPU to have caught fire again\n")
+	}
+	if err := c.LoadState(b); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if c.CaughtFire() || c.StepN(3) != 3 {
+		t.Errorf("Expected LoadState to put out the fire\n")
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	c := NewDCPU16()
+	c.period = time.Nanosecond
+	c.Write(0, []uint16{
+		makeOpcode(SET, A, 0x1f), 0x1234, // SET A, 0x1234
+		makeOpcode(SET, PUSH, A), // SET PUSH, A
+	})
+	c.Step()
+	c.Step()
+
+	b := new(bytes.Buffer)
+	if err := c.SaveState(b); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	data := b.Bytes()
+
+	d := NewDCPU16()
+	if err := d.LoadState(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	checkRegisters(c.Registers(), d, t, "LoadState")
+	if v := d.Read(LASTADDR, 1)[0]; v != 0x1234 {
+		t.Errorf("Expected 0x1234 at 0x%04x, got 0x%04x\n", LASTADDR, v)
+	}
+
+	if err := d.LoadState(bytes.NewReader(data[:len(data)/2])); err == nil {
+		t.Errorf("Expected an error loading a truncated state\n")
+	}
+	if err := d.LoadState(bytes.NewReader([]byte("not a state"))); err == nil {
+		t.Errorf("Expected an error loading malformed data\n")
+	}
+}
@@ -0,0 +1,113 @@
+package disasm
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/markcol/dcpu16/cpu"
+)
+
+// Device describes a hardware device for annotating disassembly. Messages
+// maps the interrupt message passed in register A to the name of the
+// operation it requests.
+type Device struct {
+	Name     string
+	Messages map[uint16]string
+}
+
+// Well known devices.
+var (
+	LEM1802 = Device{"LEM1802", map[uint16]string{
+		0: "MEM_MAP_SCREEN", 1: "MEM_MAP_FONT", 2: "MEM_MAP_PALETTE",
+		3: "SET_BORDER_COLOR", 4: "MEM_DUMP_FONT", 5: "MEM_DUMP_PALETTE",
+	}}
+	Keyboard = Device{"Keyboard", map[uint16]string{
+		0: "CLEAR_BUFFER", 1: "GET_KEY", 2: "KEY_PRESSED", 3: "SET_INTERRUPT",
+	}}
+	Clock = Device{"Clock", map[uint16]string{
+		0: "SET_RATE", 1: "GET_TICKS", 2: "SET_INTERRUPT",
+	}}
+)
+
+// DisassembleAnnotated disassembles like Disassemble, and annotates device
+// calls. Whenever a SET A, <literal> is followed by HWI <literal> and devices
+// maps that hardware index to a known device, a comment naming the device
+// operation is appended to the HWI line, e.g. "; LEM1802 MEM_MAP_SCREEN".
+// Instructions between the two may set other registers, but not A, and must
+// not change the flow of control.
+func DisassembleAnnotated(addr uint16, r WordReader, w io.Writer, symbols map[uint16]string, devices map[uint16]Device) error {
+	return disasm(addr, r, w, symbols, nil, devices)
+}
+
+// annotator tracks the message last set in register A, to annotate the HWI
+// instructions that follow it.
+type annotator struct {
+	devices map[uint16]Device
+	msg     uint16
+	haveMsg bool
+}
+
+// reset forgets the message in A.
+func (an *annotator) reset() { an.haveMsg = false }
+
+// note returns the annotation for the decoded instruction in, whose first
+// word is v and whose operand words are next, or "" if there is none.
+func (an *annotator) note(in cpu.Instruction, v uint16, next []uint16) string {
+	op := v & cpu.OPCODE_MASK
+	a := (v & cpu.ARGA_MASK) >> cpu.ARGA_SHIFT
+	b := (v & cpu.ARGB_MASK) >> cpu.ARGB_SHIFT
+	switch {
+	case op == cpu.EXT && b == cpu.HWI:
+		defer an.reset()
+		if idx, ok := literal(a, next); ok && an.haveMsg {
+			if d, ok := an.devices[idx]; ok {
+				return fmt.Sprintf("\t; %s %s", d.Name, d.opName(an.msg))
+			}
+		}
+	case op == cpu.SET && b == cpu.A:
+		an.msg, an.haveMsg = literal(a, next)
+	case clobbersMessage(in, op, a, b):
+		an.reset()
+	}
+	return ""
+}
+
+// clobbersMessage reports whether instruction in, with opcode op and operand
+// modes a and b, may write register A or change the flow of control, so that
+// a message previously set in A cannot be relied on afterwards.
+func clobbersMessage(in cpu.Instruction, op, a, b uint16) bool {
+	if in.Mnemonic == "DAT" {
+		return true
+	}
+	if op == cpu.EXT {
+		switch b {
+		case cpu.JSR, cpu.INT, cpu.RFI, cpu.HWN, cpu.HWQ:
+			return true
+		case cpu.IAG:
+			return a == cpu.A
+		}
+		return false
+	}
+	return b == cpu.A || b == 0x1c || (op >= cpu.IFB && op <= cpu.IFU)
+}
+
+// opName returns the name of the operation requested by message msg.
+func (d Device) opName(msg uint16) string {
+	if name, ok := d.Messages[msg]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", msg)
+}
+
+// literal returns the value of an a operand with addressing mode mode if it
+// is a short or next-word literal. The a operand's next word, if any, is the
+// first of next.
+func literal(mode uint16, next []uint16) (uint16, bool) {
+	switch {
+	case mode == 0x1f && len(next) > 0:
+		return next[0], true
+	case mode >= 0x20:
+		return cpu.ShortLiteral(mode), true
+	}
+	return 0, false
+}
@@ -0,0 +1,52 @@
+package disasm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDisassembleAnnotated(t *testing.T) {
+	mem := []uint16{
+		0x8401,         // SET A, 0
+		0x7c21, 0x8000, // SET B, 0x8000
+		0x8a40, // HWI 1
+		0x8801, // SET A, 1
+		0x8802, // ADD A, 1
+		0x8a40, // HWI 1
+		0x8401, // SET A, 0
+		0x8432, // IFE B, 0
+		0x8a40, // HWI 1
+		0x8401, // SET A, 0
+		0x8a40, // HWI 1
+	}
+	devices := map[uint16]Device{1: LEM1802}
+
+	expect := "0x0000:\t\tSET\tA, 0x00\n" +
+		"0x0001:\t\tSET\tB, 0x8000\n" +
+		"0x0003:\t\tHWI\t0x01\t; LEM1802 MEM_MAP_SCREEN\n" +
+		"0x0004:\t\tSET\tA, 0x01\n" +
+		"0x0005:\t\tADD\tA, 0x01\n" +
+		"0x0006:\t\tHWI\t0x01\n" +
+		"0x0007:\t\tSET\tA, 0x00\n" +
+		"0x0008:\t\tIFE\tB, 0x00\n" +
+		"0x0009:\t\tHWI\t0x01\n" +
+		"0x000a:\t\tSET\tA, 0x00\n" +
+		"0x000b:\t\tHWI\t0x01\t; LEM1802 MEM_MAP_SCREEN\n\n"
+
+	b := new(bytes.Buffer)
+	if err := DisassembleAnnotated(0, NewWordReader(mem), b, nil, devices); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if b.String() != expect {
+		t.Errorf("Expected:\n%s\ngot:\n%s\n", expect, b)
+	}
+
+	// without a device map nothing is annotated
+	b.Reset()
+	if err := DisassembleAnnotated(10, NewWordReader(mem[10:]), b, nil, nil); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if e := "0x000a:\t\tSET\tA, 0x00\n0x000b:\t\tHWI\t0x01\n\n"; b.String() != e {
+		t.Errorf("Expected:\n%s\ngot:\n%s\n", e, b)
+	}
+}
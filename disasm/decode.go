@@ -0,0 +1,17 @@
+package disasm
+
+import (
+	"github.com/markcol/dcpu16/cpu"
+)
+
+// Instruction is a single instruction decoded using the DCPU-16 1.7
+// encoding.
+type Instruction = cpu.Instruction
+
+// Decode decodes the instruction starting at m[addr]. Words that do not
+// form a valid instruction are returned as a single word DAT. If the
+// instruction's operand words extend past the end of m, the partially
+// decoded instruction is returned along with io.ErrUnexpectedEOF.
+func Decode(m []uint16, addr uint16) (Instruction, error) {
+	return cpu.Decode(m, addr)
+}
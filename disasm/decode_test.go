@@ -0,0 +1,46 @@
+package disasm
+
+import (
+	"testing"
+)
+
+func TestDecodePick(t *testing.T) {
+	mem := []uint16{0x6801, 0x0003} // SET A, PICK 3
+
+	in, err := Decode(mem, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if in.Length != 2 {
+		t.Errorf("Expected length 2, got %d\n", in.Length)
+	}
+	if in.Mnemonic != "SET" || len(in.Operands) != 2 || in.Operands[0] != "A" || in.Operands[1] != "PICK 3" {
+		t.Errorf("Expected SET A, PICK 3, got %s\n", in)
+	}
+}
+
+func TestDecodePushPop(t *testing.T) {
+	mem := []uint16{
+		0x0301, // SET PUSH, A
+		0x6021, // SET B, POP
+	}
+	expect := []string{"SET PUSH, A", "SET B, POP"}
+
+	for i, e := range expect {
+		in, err := Decode(mem, uint16(i))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		if in.String() != e || in.Length != 1 {
+			t.Errorf("Expected %q (length 1), got %q (length %d)\n", e, in, in.Length)
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	mem := []uint16{0x6801} // SET A, PICK <missing>
+
+	if _, err := Decode(mem, 0); err == nil {
+		t.Errorf("Expected an error decoding a truncated instruction\n")
+	}
+}
@@ -1,13 +1,12 @@
 package disasm
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-)
+	"strings"
 
-var (
-	register = []string{"A", "B", "C", "X", "Y", "Z", "I", "J"}
-	opcodes  = map[int]string{1: "SET", 2: "ADD", 3: "SUB", 4: "MUL", 5: "DIV", 6: "MOD", 7: "SHL", 8: "SHR", 9: "AND", 10: "BOR", 11: "XOR", 12: "IFE", 13: "IFN", 14: "IFG", 15: "IFB"}
+	"github.com/markcol/dcpu16/cpu"
 )
 
 type wordReader struct {
@@ -30,75 +29,95 @@ type WordReader interface {
 	ReadWord() (w uint16, err error)
 }
 
-func disasm(addr uint16, r WordReader, w io.Writer) {
-	var a, b string
-	var err error
-	var v uint16
+// RegionKind is the kind of words in a Region.
+type RegionKind int
 
-	for true {
-		oldAddr := addr
-		v, err = r.ReadWord()
-		addr++
-		if err != nil {
+// Region kinds
+const (
+	REGION_CODE RegionKind = iota
+	REGION_DATA
+)
+
+// Region marks the inclusive address range [Start, End] as holding code or
+// data.
+type Region struct {
+	Start, End uint16
+	Kind       RegionKind
+}
+
+// Disassemble reads words from r and writes their disassembly to w, one
+// instruction per line, numbering them from address addr. It stops without
+// error when r returns io.EOF at an instruction boundary; an instruction cut
+// short returns io.ErrUnexpectedEOF, and any other read error is returned.
+//
+// If symbols is not nil, operand words that match an address in symbols are
+// written as the symbol name (e.g. "SET PC, loop") rather than in hex.
+func Disassemble(addr uint16, r WordReader, w io.Writer, symbols map[uint16]string) error {
+	return disasm(addr, r, w, symbols, nil, nil)
+}
+
+// DisassembleRegions disassembles like Disassemble, except that words in a
+// REGION_DATA region of regions are written as raw data rather than decoded,
+// so that tables and strings do not throw the disassembly out of step with
+// the code that follows them. Addresses outside every region are code.
+func DisassembleRegions(addr uint16, r WordReader, w io.Writer, symbols map[uint16]string, regions []Region) error {
+	return disasm(addr, r, w, symbols, regions, nil)
+}
+
+// DisassembleWords returns the disassembly of m, numbering the instructions
+// from address addr.
+func DisassembleWords(addr uint16, m []uint16) (string, error) {
+	b := new(bytes.Buffer)
+	err := Disassemble(addr, NewWordReader(m), b, nil)
+	return b.String(), err
+}
+
+func disasm(addr uint16, r WordReader, w io.Writer, symbols map[uint16]string, regions []Region, devices map[uint16]Device) error {
+	an := annotator{devices: devices}
+	for {
+		v, err := r.ReadWord()
+		if err == io.EOF {
 			break
+		} else if err != nil {
+			return err
 		}
-		op := v & 0x0f
-		if op >= 0x01 && op <= 0x0f {
-			a, addr, err = addrMode(v>>4&0x3f, addr, r)
-			if err != nil {
-				break
-			}
-			b, addr, err = addrMode(v>>10&0x3f, addr, r)
+		var line string
+		if isData(addr, regions) {
+			line = fmt.Sprintf("0x%04x:\t%04x\n", addr, v)
+			an.reset()
+		} else {
+			var next []uint16
+			in, err := cpu.DecodeWord(addr, v, func() (uint16, error) {
+				n, err := r.ReadWord()
+				next = append(next, n)
+				return n, err
+			}, symbols)
 			if err != nil {
-				break
+				return err
 			}
-			w.Write([]byte(fmt.Sprintf("0x%04x:\t\t%s\t%s, %s\n", oldAddr, opcodes[int(op)], a, b)))
-		} else if op == 0 && (v&0x3f) == 0x10 {
-			a, addr, err = addrMode(v>>10&0x3f, addr, r)
-			if err != nil {
-				break
+			note := an.note(in, v, next)
+			if in.Mnemonic == "DAT" {
+				line = fmt.Sprintf("0x%04x:\t%04x\n", addr, v)
+			} else {
+				line = fmt.Sprintf("0x%04x:\t\t%s\t%s%s\n", addr, in.Mnemonic, strings.Join(in.Operands, ", "), note)
 			}
-			w.Write([]byte(fmt.Sprintf("0x%04x:\t\tJSR\t%s\n", oldAddr, a)))
-		} else {
-			w.Write([]byte(fmt.Sprintf("0x%04x:\t%04x\n", oldAddr, v)))
+			addr += in.Length - 1
+		}
+		addr++
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
 		}
 	}
-	w.Write([]byte("\n"))
+	_, err := io.WriteString(w, "\n")
+	return err
 }
 
-func addrMode(opcode uint16, a uint16, r WordReader) (s string, addr uint16, err error) {
-	addr = a
-	switch {
-	case opcode <= 0x07:
-		return register[opcode], addr, nil
-	case opcode <= 0x0f:
-		return fmt.Sprintf("[%s]", register[opcode-0x08]), addr, nil
-	case opcode <= 0x17:
-		v, err := r.ReadWord()
-		addr++
-		return fmt.Sprintf("[0x%x+%s]", v, register[opcode-0x10]), addr, err
-	case opcode <= 0x18:
-		return "POP", addr, nil
-	case opcode == 0x19:
-		return "PEEK", addr, nil
-	case opcode == 0x1a:
-		return "PUSH", addr, nil
-	case opcode == 0x1b:
-		return "SP", addr, nil
-	case opcode == 0x1c:
-		return "PC", addr, nil
-	case opcode == 0x1d:
-		return "O", addr, nil
-	case opcode == 0x1e:
-		v, err := r.ReadWord()
-		addr++
-		return fmt.Sprintf("[0x%x]", v), addr, err
-	case opcode == 0x1f:
-		v, err := r.ReadWord()
-		addr++
-		return fmt.Sprintf("0x%x", v), addr, err
-	case opcode >= 0x020 && opcode <= 0x3f:
-		return fmt.Sprintf("0x%02x", opcode-0x20), addr, nil
+// isData reports whether addr lies in a REGION_DATA region of regions.
+func isData(addr uint16, regions []Region) bool {
+	for _, r := range regions {
+		if r.Kind == REGION_DATA && addr >= r.Start && addr <= r.End {
+			return true
+		}
 	}
-	return "Unknown", addr, nil
+	return false
 }
@@ -2,15 +2,21 @@ package disasm
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
+
+	"github.com/markcol/dcpu16/asm"
+	"github.com/markcol/dcpu16/cpu"
 )
 
 func TestBasic(t *testing.T) {
 	mem := []uint16{
-		0x7c01, 0x0030, 0x7de1, 0x1000, 0x0020, 0x7803, 0x1000, 0xc00d,
-		0x7dc1, 0x001a, 0xa861, 0x7c01, 0x2000, 0x2161, 0x2000, 0x8463,
-		0x806d, 0x7dc1, 0x000d, 0x9031, 0x7c10, 0x0018, 0x7dc1, 0x001a,
-		0x9037, 0x61c1, 0x7dc1, 0x001a,
+		0x7c01, 0x0030, 0x7fc1, 0x0020, 0x1000, 0x7803, 0x1000, 0xc413,
+		0x7f81, 0x001a, 0xacc1, 0x7c01, 0x2000, 0x22c1, 0x2000, 0x88c3,
+		0x84d3, 0x7f81, 0x000d, 0x9461, 0x7c20, 0x0018, 0x7f81, 0x001a,
+		0x946f, 0x6381, 0x7f81, 0x001a,
 	}
 
 	expect := []byte("0x0000:		SET	A, 0x30\n" +
@@ -33,7 +39,7 @@ func TestBasic(t *testing.T) {
 
 	b := bytes.NewBuffer(make([]byte, 0, 1024))
 
-	disasm(0x000, NewWordReader(mem), b)
+	disasm(0x000, NewWordReader(mem), b, nil, nil, nil)
 	if b.Len() != len(expect) {
 		t.Errorf("Expected lengths to be: %d, got %d\n", len(expect), b.Len())
 	}
@@ -41,3 +47,203 @@ func TestBasic(t *testing.T) {
 		t.Errorf("Expected results to be the same, but were not:\nexpected:%v\ngot:%v\n", b, expect)
 	}
 }
+
+func TestDisassembleWords(t *testing.T) {
+	// the assembler sample
+	mem := []uint16{
+		0x7c01, 0x0030, 0x7fc1, 0x0020, 0x1000, 0x7803, 0x1000, 0xc413,
+		0x7f81, 0x001a, 0xacc1, 0x7c01, 0x2000, 0x22c1, 0x2000, 0x88c3,
+		0x84d3, 0x7f81, 0x000d, 0x9461, 0x7c20, 0x0018, 0x7f81, 0x001a,
+		0x946f, 0x6381, 0x7f81, 0x001a,
+	}
+	expect := []string{
+		"SET", "SET", "SUB", "IFN", "SET", "SET", "SET", "SET", "SUB",
+		"IFN", "SET", "SET", "JSR", "SET", "SHL", "SET", "SET",
+	}
+
+	s, err := DisassembleWords(0, mem)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) != len(expect) {
+		t.Fatalf("Expected %d lines, got %d\n", len(expect), len(lines))
+	}
+	for i, line := range lines {
+		if f := strings.Fields(line); len(f) < 2 || f[1] != expect[i] {
+			t.Errorf("line %d: expected %s, got %q\n", i, expect[i], line)
+		}
+	}
+
+	// an instruction missing its next word
+	if _, err := DisassembleWords(0, mem[:1]); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v\n", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	src := ":start SET A, PICK 2\n" +
+		"       SET EX, 0x10\n" +
+		"       ADD [0x1000+B], 0xffff\n" +
+		"       JSR start\n"
+	expect := "0x0000:\t\tSET\tA, PICK 2\n" +
+		"0x0002:\t\tSET\tEX, 0x10\n" +
+		"0x0003:\t\tADD\t[0x1000+B], 0xffff\n" +
+		"0x0005:\t\tJSR\t0x0\n\n"
+
+	var words wordBuffer
+	if err := asm.Assemble(strings.NewReader(src), &words); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	c := cpu.NewDCPU16()
+	c.Write(0, words)
+
+	s, err := DisassembleWords(0, c.Read(0, len(words)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if s != expect {
+		t.Errorf("Expected:\n%s\ngot:\n%s\n", expect, s)
+	}
+}
+
+// wordBuffer is an asm.WordWriter that collects the words written to it.
+type wordBuffer []uint16
+
+func (b *wordBuffer) WriteWord(w uint16) error {
+	*b = append(*b, w)
+	return nil
+}
+
+func TestExtendedOpcodes(t *testing.T) {
+	tests := []struct {
+		word   uint16
+		expect string
+	}{
+		{0x0020, "\t\tJSR\tA"},
+		{0xc500, "\t\tINT\t0x10"},
+		{0x0d20, "\t\tIAG\tX"},
+		{0x0140, "\t\tIAS\tA"},
+		{0x0160, "\t\tRFI\tA"},
+		{0x0180, "\t\tIAQ\tA"},
+		{0x0200, "\t\tHWN\tA"},
+		{0x0220, "\t\tHWQ\tA"},
+		{0x0240, "\t\tHWI\tA"},
+		{0x01e0, "\t01e0"}, // undefined extended opcode 0x0f
+	}
+
+	for _, test := range tests {
+		s, err := DisassembleWords(0, []uint16{test.word})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		if e := "0x0000:" + test.expect + "\n\n"; s != e {
+			t.Errorf("0x%04x: expected %q, got %q\n", test.word, e, s)
+		}
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	mem := []uint16{
+		0x7f81, 0x0003, // SET PC, 0x0003
+		0x7801, 0x1000, // SET A, [0x1000]
+		0x7f81, 0x0004, // SET PC, 0x0004
+	}
+	symbols := map[uint16]string{3: "loop", 0x1000: "data"}
+	expect := "0x0000:\t\tSET\tPC, loop\n" +
+		"0x0002:\t\tSET\tA, [data]\n" +
+		"0x0004:\t\tSET\tPC, 0x4\n\n"
+
+	b := new(bytes.Buffer)
+	if err := Disassemble(0, NewWordReader(mem), b, symbols); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if b.String() != expect {
+		t.Errorf("Expected:\n%s\ngot:\n%s\n", expect, b)
+	}
+}
+
+func TestPushPop(t *testing.T) {
+	mem := []uint16{
+		0x0301, // SET PUSH, A
+		0x6021, // SET B, POP
+		0x6701, // SET PUSH, PEEK
+	}
+	expect := "0x0000:\t\tSET\tPUSH, A\n" +
+		"0x0001:\t\tSET\tB, POP\n" +
+		"0x0002:\t\tSET\tPUSH, PEEK\n\n"
+
+	s, err := DisassembleWords(0, mem)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if s != expect {
+		t.Errorf("Expected:\n%s\ngot:\n%s\n", expect, s)
+	}
+}
+
+func TestRegions(t *testing.T) {
+	mem := []uint16{
+		0x7c01, 0x0030, // SET A, 0x30
+		0x0048, 0x0069, 0x0021, // DAT "Hi!"
+		0x6381, // SET PC, POP
+	}
+	regions := []Region{{Start: 2, End: 4, Kind: REGION_DATA}}
+	expect := "0x0000:\t\tSET\tA, 0x30\n" +
+		"0x0002:\t0048\n" +
+		"0x0003:\t0069\n" +
+		"0x0004:\t0021\n" +
+		"0x0005:\t\tSET\tPC, POP\n\n"
+
+	b := new(bytes.Buffer)
+	if err := DisassembleRegions(0, NewWordReader(mem), b, nil, regions); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if b.String() != expect {
+		t.Errorf("Expected:\n%s\ngot:\n%s\n", expect, b)
+	}
+
+	// without regions, the string is decoded as instructions
+	s, err := DisassembleWords(0, mem)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if s == expect {
+		t.Errorf("Expected the string to be decoded as instructions\n")
+	}
+}
+
+// TestShortLiterals checks that the CPU, both disassemblers and the assembler
+// agree on the value of every short literal.
+func TestShortLiterals(t *testing.T) {
+	for mode := uint16(0x20); mode <= 0x3f; mode++ {
+		v := cpu.ShortLiteral(mode)
+		word := mode<<cpu.ARGA_SHIFT | cpu.SET // SET A, literal
+
+		c := cpu.NewDCPU16()
+		c.SetClockRate(0)
+		c.Write(0, []uint16{word})
+		c.Step()
+		if a := c.Registers()[cpu.A]; a != v {
+			t.Errorf("mode 0x%02x: CPU loaded 0x%04x, want 0x%04x\n", mode, a, v)
+		}
+
+		want := fmt.Sprintf("SET A, 0x%02x", v)
+		c.SetRegister("PC", 0)
+		if s, _ := c.DisassembleNext(); s != want {
+			t.Errorf("mode 0x%02x: cpu disassembled %q, want %q\n", mode, s, want)
+		}
+		if s, _ := DisassembleWords(0, []uint16{word}); strings.Join(strings.Fields(s)[1:], " ") != want {
+			t.Errorf("mode 0x%02x: disasm disassembled %q, want %q\n", mode, s, want)
+		}
+		if in, err := Decode([]uint16{word}, 0); err != nil || in.String() != want {
+			t.Errorf("mode 0x%02x: Decode returned %q (%v), want %q\n", mode, in, err, want)
+		}
+
+		var b wordBuffer
+		src := fmt.Sprintf("SET A, 0x%x", v)
+		if err := asm.Assemble(strings.NewReader(src), &b); err != nil || len(b) != 1 || b[0] != word {
+			t.Errorf("mode 0x%02x: %q assembled to %04x (%v), want %04x\n", mode, src, b, err, word)
+		}
+	}
+}